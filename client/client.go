@@ -0,0 +1,235 @@
+//Package client is a Go client of the sdcc broker: it logs in, publishes, reads notifications and encrypts and decrypts
+//messages of private topics, whose keys the broker only stores sealed to the public keys of their members
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Message as sent and received by the broker
+type Message struct {
+	ID             string            `json:"ID,omitempty"`
+	Message        string            `json:"Message"`
+	Title          string            `json:"Title"`
+	ContentType    string            `json:"ContentType,omitempty"`
+	Headers        map[string]string `json:"Headers,omitempty"` //never encrypted, the broker filters on them
+	Body           json.RawMessage   `json:"Body,omitempty"`
+	Data           []byte            `json:"Data,omitempty"`
+	Topic          string            `json:"Topic"`
+	RequestID      string            `json:"RequestID,omitempty"`
+	Offset         int64             `json:"Offset,omitempty"`
+	Radius         int               `json:"Radius,string"`
+	LifeTime       int               `json:"LifeTime,string"`
+	InsertionTime  time.Time         `json:"InsertionTime"`
+	ExpirationTime time.Time         `json:"ExpirationTime"`
+	Latitude       float64           `json:"Latitude"`
+	Longitude      float64           `json:"Longitude"`
+	PartitionKey   string            `json:"PartitionKey,omitempty"`
+	Attachments    []Attachment      `json:"Attachments,omitempty"`
+	Encryption     *Encryption       `json:"Encryption,omitempty"`
+}
+
+type Attachment struct {
+	ID          string `json:"ID"`
+	Name        string `json:"Name"`
+	ContentType string `json:"ContentType"`
+	Size        int64  `json:"Size"`
+	URL         string `json:"URL"`
+}
+
+//Outcome of a publish: Result is "success", "fail" (the message can be sent again) or "rejected" with Reason
+type PublishResult struct {
+	Result         string `json:"Result"`
+	Reason         string `json:"Reason,omitempty"`
+	Offset         int64  `json:"Offset,omitempty"`
+	Partition      int    `json:"Partition"`
+	LifeTime       int    `json:"LifeTime"`
+	LifetimeCapped bool   `json:"LifetimeCapped,omitempty"`
+	Dropped        int    `json:"Dropped,omitempty"`
+}
+
+//Answer of the broker with a status other than 200
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+
+	return fmt.Sprintf("sdcc: %d %s", e.StatusCode, e.Message)
+}
+
+//Client of a broker, safe for concurrent use. Session cookies are kept by its HTTP client
+type Client struct {
+	baseURL string
+	http    *http.Client
+	keys    *KeyPair //nil if the user does not use private topics
+
+	topicKeys map[string]map[int][]byte //key: topic - value: opened topic keys by version
+	rm        sync.Mutex
+}
+
+//Creating a client of the broker at baseURL (e.g. https://localhost:8080). keys are needed for private topics only
+func New(baseURL string, keys *KeyPair) (*Client, error) {
+
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		http:      &http.Client{Jar: jar, Timeout: 30 * time.Second},
+		keys:      keys,
+		topicKeys: map[string]map[int][]byte{},
+	}, nil
+}
+
+//Sending request with JSON body, decoding the JSON answer into result if not nil. Answers other than 200 are returned as
+//*StatusError, result is decoded also then when possible
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+
+	var reader io.Reader
+
+	if body != nil {
+
+		encoded, err := json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.http.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	answer, err := io.ReadAll(io.LimitReader(response.Body, 64<<20))
+
+	if err != nil {
+		return err
+	}
+
+	if result != nil && len(answer) > 0 {
+
+		if decodeErr := json.Unmarshal(answer, result); decodeErr != nil && response.StatusCode == http.StatusOK {
+			return decodeErr
+		}
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(answer))}
+	}
+
+	return nil
+}
+
+//Logging in, the session lasts token-expiration-time minutes of the broker
+func (c *Client) Login(ctx context.Context, email string, password string) error {
+
+	return c.do(ctx, http.MethodPost, "/login", map[string]string{"Email": email, "Password": password}, nil)
+}
+
+//Publishing message as it is, see PublishEncrypted for private topics
+func (c *Client) Publish(ctx context.Context, message Message) (PublishResult, error) {
+
+	var result PublishResult
+	err := c.do(ctx, http.MethodPost, "/publish", message, &result)
+
+	return result, err
+}
+
+//Subscribing to topic with an optional filter, or unsubscribing if already subscribed
+func (c *Client) EditSubscription(ctx context.Context, topic string, filter string) error {
+
+	return c.do(ctx, http.MethodPost, "/editSubscription", map[string]string{"Topic": topic, "Filter": filter}, nil)
+}
+
+//Getting active messages of subscribed topics in range of the position, messages of private topics are decrypted
+func (c *Client) Notifications(ctx context.Context, latitude float64, longitude float64, radius int) ([]Message, error) {
+
+	var messages []Message
+	err := c.do(ctx, http.MethodPost, "/notifications", Message{Latitude: latitude, Longitude: longitude, Radius: radius},
+		&messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decryptAll(ctx, messages)
+}
+
+//Getting messages of topic from offset kept for replay, messages of private topics are decrypted
+func (c *Client) Replay(ctx context.Context, topic string, offset int64, limit int) ([]Message, error) {
+
+	query := url.Values{"topic": {topic}, "offset": {strconv.FormatInt(offset, 10)}}
+
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var messages []Message
+
+	if err := c.do(ctx, http.MethodGet, "/replay?"+query.Encode(), nil, &messages); err != nil {
+		return nil, err
+	}
+
+	return c.decryptAll(ctx, messages)
+}
+
+func (c *Client) decryptAll(ctx context.Context, messages []Message) ([]Message, error) {
+
+	for i, message := range messages {
+
+		if message.Encryption == nil {
+			continue
+		}
+
+		decrypted, err := c.Decrypt(ctx, message)
+
+		if err != nil {
+			return nil, fmt.Errorf("message %s not decrypted: %w", message.ID, err)
+		}
+
+		messages[i] = decrypted
+	}
+
+	return messages, nil
+}
+
+//Checking if err is a StatusError with status code
+func IsStatus(err error, code int) bool {
+
+	var statusErr *StatusError
+
+	return errors.As(err, &statusErr) && statusErr.StatusCode == code
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/nacl/box"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//Algorithm of encrypted messages: AES-256-GCM with the topic key, nonce prepended to the ciphertext in Data
+const Algorithm = "A256GCM"
+
+//Encryption of a message on a private topic
+type Encryption struct {
+	Algorithm  string `json:"Algorithm"`
+	KeyVersion int    `json:"KeyVersion"`
+}
+
+//X25519 key pair of a user. Only Public is sent to the broker, Private must be kept by the user: topic keys sealed to
+//Public cannot be opened without it
+type KeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+//Fields of a message travelling inside the ciphertext
+type sealedPayload struct {
+	Title       string          `json:"Title,omitempty"`
+	Message     string          `json:"Message,omitempty"`
+	ContentType string          `json:"ContentType,omitempty"`
+	Body        json.RawMessage `json:"Body,omitempty"`
+	Data        []byte          `json:"Data,omitempty"`
+}
+
+type publicKey struct {
+	Email     string `json:"Email"`
+	PublicKey []byte `json:"PublicKey"`
+}
+
+type topicKey struct {
+	Topic   string `json:"Topic"`
+	Version int    `json:"Version"`
+	Key     []byte `json:"Key"`
+}
+
+type topicKeys struct {
+	Topic   string            `json:"Topic"`
+	Version int               `json:"Version"`
+	Keys    map[string][]byte `json:"Keys"`
+}
+
+var errNoKeyPair = errors.New("sdcc: key pair needed for private topics")
+
+func GenerateKeyPair() (*KeyPair, error) {
+
+	public, private, err := box.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{Public: *public, Private: *private}, nil
+}
+
+//Registering the public key of the key pair for the session user, members seal topic keys to it
+func (c *Client) RegisterPublicKey(ctx context.Context) error {
+
+	if c.keys == nil {
+		return errNoKeyPair
+	}
+
+	return c.do(ctx, http.MethodPost, "/publicKey", publicKey{PublicKey: c.keys.Public[:]}, nil)
+}
+
+//Creating a new version of the key of a private topic, sealed to every member with a registered public key. Members
+//without one get it through ShareTopicKey once they register. Keys should be rotated when members are removed
+func (c *Client) RotateTopicKey(ctx context.Context, topic string) (int, error) {
+
+	version, _, err := c.latestTopicKey(ctx, topic)
+
+	if err != nil && !IsStatus(err, http.StatusNotFound) {
+		return 0, err
+	}
+
+	key := make([]byte, 32)
+
+	if _, err = rand.Read(key); err != nil {
+		return 0, err
+	}
+
+	if err = c.sealTopicKey(ctx, topic, version+1, key); err != nil {
+		return 0, err
+	}
+
+	c.cacheTopicKey(topic, version+1, key)
+
+	return version + 1, nil
+}
+
+//Sealing the current key of a private topic to members with a registered public key that have no copy of it yet
+func (c *Client) ShareTopicKey(ctx context.Context, topic string) error {
+
+	version, key, err := c.latestTopicKey(ctx, topic)
+
+	if err != nil {
+		return err
+	}
+
+	return c.sealTopicKey(ctx, topic, version, key)
+}
+
+//Uploading key of topic sealed to the public key of every member, copies already stored are kept by the broker
+func (c *Client) sealTopicKey(ctx context.Context, topic string, version int, key []byte) error {
+
+	var members []publicKey
+
+	if err := c.do(ctx, http.MethodGet, "/publicKeys?topic="+url.QueryEscape(topic), nil, &members); err != nil {
+		return err
+	}
+
+	sealed := topicKeys{Topic: topic, Version: version, Keys: map[string][]byte{}}
+
+	for _, member := range members {
+
+		if len(member.PublicKey) != 32 {
+			return fmt.Errorf("sdcc: public key of %s not valid", member.Email)
+		}
+
+		var recipient [32]byte
+		copy(recipient[:], member.PublicKey)
+
+		seal, err := box.SealAnonymous(nil, key, &recipient, rand.Reader)
+
+		if err != nil {
+			return err
+		}
+
+		sealed.Keys[member.Email] = seal
+	}
+
+	if len(sealed.Keys) == 0 {
+		return errors.New("sdcc: no member of " + topic + " registered a public key")
+	}
+
+	return c.do(ctx, http.MethodPost, "/topicKeys", sealed, nil)
+}
+
+//Getting the latest key of topic sealed to the user and opening it
+func (c *Client) latestTopicKey(ctx context.Context, topic string) (int, []byte, error) {
+
+	return c.fetchTopicKey(ctx, topic, 0)
+}
+
+//Getting key of topic of version (0 for the latest) from the broker and opening it with the private key
+func (c *Client) fetchTopicKey(ctx context.Context, topic string, version int) (int, []byte, error) {
+
+	if c.keys == nil {
+		return 0, nil, errNoKeyPair
+	}
+
+	query := url.Values{"topic": {topic}, "version": {strconv.Itoa(version)}}
+
+	var sealed topicKey
+
+	if err := c.do(ctx, http.MethodGet, "/topicKey?"+query.Encode(), nil, &sealed); err != nil {
+		return 0, nil, err
+	}
+
+	key, ok := box.OpenAnonymous(nil, sealed.Key, &c.keys.Public, &c.keys.Private)
+
+	if !ok {
+		return 0, nil, fmt.Errorf("sdcc: key %d of %s not sealed to this key pair", sealed.Version, topic)
+	}
+
+	c.cacheTopicKey(topic, sealed.Version, key)
+
+	return sealed.Version, key, nil
+}
+
+//Getting key of topic of version, from cache if already opened
+func (c *Client) topicKey(ctx context.Context, topic string, version int) ([]byte, error) {
+
+	c.rm.Lock()
+	key, found := c.topicKeys[topic][version]
+	c.rm.Unlock()
+
+	if found {
+		return key, nil
+	}
+
+	_, key, err := c.fetchTopicKey(ctx, topic, version)
+
+	return key, err
+}
+
+func (c *Client) cacheTopicKey(topic string, version int, key []byte) {
+
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	if c.topicKeys[topic] == nil {
+		c.topicKeys[topic] = map[int][]byte{}
+	}
+
+	c.topicKeys[topic][version] = key
+}
+
+//AES-256-GCM of topic key, ciphertexts are bound to topic and key version
+func topicCipher(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func additionalData(topic string, version int) []byte {
+
+	return []byte(topic + "\x00" + strconv.Itoa(version))
+}
+
+//Encrypting Title, Message, ContentType, Body and Data of message with the latest key of its topic. Headers, position,
+//radius and lifetime stay readable by the broker, which routes on them
+func (c *Client) Encrypt(ctx context.Context, message Message) (Message, error) {
+
+	version, key, err := c.latestTopicKey(ctx, message.Topic)
+
+	if err != nil {
+		return message, err
+	}
+
+	plaintext, err := json.Marshal(sealedPayload{message.Title, message.Message, message.ContentType, message.Body, message.Data})
+
+	if err != nil {
+		return message, err
+	}
+
+	aead, err := topicCipher(key)
+
+	if err != nil {
+		return message, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return message, err
+	}
+
+	message.Title, message.Message, message.ContentType, message.Body = "", "", "", nil
+	message.Data = aead.Seal(nonce, nonce, plaintext, additionalData(message.Topic, version))
+	message.Encryption = &Encryption{Algorithm: Algorithm, KeyVersion: version}
+
+	return message, nil
+}
+
+//Decrypting a message of a private topic with the key version it was encrypted with
+func (c *Client) Decrypt(ctx context.Context, message Message) (Message, error) {
+
+	if message.Encryption == nil {
+		return message, nil
+	}
+
+	if message.Encryption.Algorithm != Algorithm {
+		return message, fmt.Errorf("sdcc: algorithm %s not supported", message.Encryption.Algorithm)
+	}
+
+	key, err := c.topicKey(ctx, message.Topic, message.Encryption.KeyVersion)
+
+	if err != nil {
+		return message, err
+	}
+
+	aead, err := topicCipher(key)
+
+	if err != nil {
+		return message, err
+	}
+
+	if len(message.Data) < aead.NonceSize() {
+		return message, errors.New("sdcc: ciphertext too short")
+	}
+
+	nonce, ciphertext := message.Data[:aead.NonceSize()], message.Data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData(message.Topic, message.Encryption.KeyVersion))
+
+	if err != nil {
+		return message, err
+	}
+
+	var payload sealedPayload
+
+	if err = json.Unmarshal(plaintext, &payload); err != nil {
+		return message, err
+	}
+
+	message.Title, message.Message, message.ContentType = payload.Title, payload.Message, payload.ContentType
+	message.Body, message.Data = payload.Body, payload.Data
+
+	return message, nil
+}
+
+//Publishing message on a private topic, encrypted with the latest key of the topic
+func (c *Client) PublishEncrypted(ctx context.Context, message Message) (PublishResult, error) {
+
+	encrypted, err := c.Encrypt(ctx, message)
+
+	if err != nil {
+		return PublishResult{}, err
+	}
+
+	return c.Publish(ctx, encrypted)
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"golang.org/x/crypto/nacl/box"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+//Broker serving keys of topic "private" sealed to keys, version 1 and 2, 2 being the latest
+func newKeyServer(t *testing.T, keys *KeyPair) *Client {
+
+	t.Helper()
+
+	topicKeys := map[int][]byte{}
+
+	for _, version := range []int{1, 2} {
+
+		key := make([]byte, 32)
+
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+
+		topicKeys[version] = key
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+
+		if version == 0 {
+			version = 2
+		}
+
+		key, found := topicKeys[version]
+
+		if r.URL.Path != "/topicKey" || r.URL.Query().Get("topic") != "private" || !found {
+
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sealed, err := box.SealAnonymous(nil, key, &keys.Public, rand.Reader)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		_ = json.NewEncoder(w).Encode(topicKey{Topic: "private", Version: version, Key: sealed})
+	}))
+
+	t.Cleanup(server.Close)
+
+	c, err := New(server.URL, keys)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+
+	keys, err := GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newKeyServer(t, keys)
+	ctx := context.Background()
+
+	message := Message{
+		Topic:       "private",
+		Title:       "Meeting",
+		Message:     "room 4 at noon",
+		ContentType: "text/plain",
+		Headers:     map[string]string{"priority": "high"},
+		Radius:      10,
+	}
+
+	encrypted, err := c.Encrypt(ctx, message)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted.Title != "" || encrypted.Message != "" || encrypted.ContentType != "" || len(encrypted.Data) == 0 {
+		t.Fatalf("plaintext left in encrypted message: %+v", encrypted)
+	}
+
+	if encrypted.Encryption == nil || encrypted.Encryption.Algorithm != Algorithm || encrypted.Encryption.KeyVersion != 2 {
+		t.Fatalf("expected latest key version: %+v", encrypted.Encryption)
+	}
+
+	if encrypted.Headers["priority"] != "high" || encrypted.Radius != 10 {
+		t.Fatalf("routing fields changed: %+v", encrypted)
+	}
+
+	//a client that opened no key yet fetches the version of the message
+	reader, err := New(c.baseURL, keys)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := reader.Decrypt(ctx, encrypted)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted.Title != message.Title || decrypted.Message != message.Message || decrypted.ContentType != message.ContentType {
+		t.Fatalf("expected %+v, got %+v", message, decrypted)
+	}
+}
+
+func TestDecryptWrongKeyVersion(t *testing.T) {
+
+	keys, err := GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newKeyServer(t, keys)
+	ctx := context.Background()
+
+	encrypted, err := c.Encrypt(ctx, Message{Topic: "private", Message: "secret"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the key version is bound to the ciphertext, the key of another version does not open it
+	encrypted.Encryption.KeyVersion = 1
+
+	if _, err = c.Decrypt(ctx, encrypted); err == nil {
+		t.Fatal("message decrypted with key version 1")
+	}
+
+	encrypted.Encryption.KeyVersion = 3
+
+	if _, err = c.Decrypt(ctx, encrypted); !IsStatus(err, http.StatusNotFound) {
+		t.Fatalf("expected 404 for a key version not stored, got %v", err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+
+	keys, err := GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newKeyServer(t, keys)
+	ctx := context.Background()
+
+	encrypted, err := c.Encrypt(ctx, Message{Topic: "private", Message: "secret"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := encrypted
+	tampered.Data = append([]byte(nil), encrypted.Data...)
+	tampered.Data[len(tampered.Data)-1] ^= 1
+
+	if _, err = c.Decrypt(ctx, tampered); err == nil {
+		t.Fatal("tampered ciphertext decrypted")
+	}
+
+	//ciphertexts are bound to their topic too
+	moved := encrypted
+	moved.Topic = "other"
+	c.cacheTopicKey("other", 2, c.topicKeys["private"][2])
+
+	if _, err = c.Decrypt(ctx, moved); err == nil {
+		t.Fatal("ciphertext of another topic decrypted")
+	}
+
+	truncated := encrypted
+	truncated.Data = encrypted.Data[:4]
+
+	if _, err = c.Decrypt(ctx, truncated); err == nil {
+		t.Fatal("truncated ciphertext decrypted")
+	}
+}
+
+func TestKeySealedToAnotherPair(t *testing.T) {
+
+	owner, err := GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newKeyServer(t, owner)
+	stranger, err := New(c.baseURL, other)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = stranger.Encrypt(context.Background(), Message{Topic: "private", Message: "secret"}); err == nil {
+		t.Fatal("key sealed to another key pair opened")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/twinj/uuid"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//File uploaded with a message, its content is kept in the blob store under ID
+type Attachment struct {
+	ID          string `json:"ID"`
+	Name        string `json:"Name"`
+	ContentType string `json:"ContentType"`
+	Size        int64  `json:"Size"`
+	URL         string `json:"URL"` //served to users who can read the message until it expires
+}
+
+//Storage of attachment contents. Keys are flat names and operations map to PutObject, GetObject and DeleteObject of
+//S3-compatible stores, so that another implementation can replace the local one
+type BlobStore interface {
+	Put(ctx context.Context, key string, contentType string, content io.Reader) (int64, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error) //content and its content type
+	Delete(ctx context.Context, key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+//Blob store keeping every blob in a file of dir, with its content type in a .type file beside it.
+//Nodes of a cluster must share dir
+type localBlobStore struct {
+	dir string
+}
+
+func newBlobStore() (BlobStore, error) {
+
+	switch config().BlobStore {
+
+	case "local":
+
+		if err := os.MkdirAll(config().BlobDir, 0o750); err != nil {
+			return nil, err
+		}
+
+		return &localBlobStore{dir: config().BlobDir}, nil
+	}
+
+	return nil, fmt.Errorf("unknown blob store %q", config().BlobStore)
+}
+
+//Getting file of key, keys are uuids generated by the broker and never contain path separators
+func (s *localBlobStore) path(key string) (string, error) {
+
+	if _, err := uuid.Parse(key); err != nil {
+		return "", errBlobNotFound
+	}
+
+	return filepath.Join(s.dir, key), nil
+}
+
+//Writing blob to a temporary file renamed when complete, so that readers never see partial blobs
+func (s *localBlobStore) Put(ctx context.Context, key string, contentType string, content io.Reader) (int64, error) {
+
+	path, err := s.path(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.CreateTemp(s.dir, ".upload-*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(file.Name())
+
+	size, err := io.Copy(file, content)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.WriteFile(path+".type", []byte(contentType), 0o640)
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(path + ".type")
+	}
+
+	return size, err
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+
+	path, err := s.path(key)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", errBlobNotFound
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType, _ := os.ReadFile(path + ".type")
+
+	return file, string(contentType), nil
+}
+
+//Deleting blob, blobs already deleted are ignored
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+
+	path, err := s.path(key)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{path, path + ".type"} {
+
+		if err = os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Receivers) initBlobs() {
+
+	blobs, err := newBlobStore()
+
+	if err != nil {
+		fatal("blob store not opened", err, "blob-store", config().BlobStore)
+	}
+
+	r.blobs = blobs
+}
+
+//Reading a multipart publish: the message JSON in field message and its files in fields attachments, stored by
+//storeAttachments once the message is accepted
+func readMultipartMessage(c *gin.Context, message *MessageData) error {
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body,
+		int64(config().AttachmentMaxCount)*config().AttachmentMaxBytes+1<<20)
+
+	if err := c.Request.ParseMultipartForm(1 << 20); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(c.Request.FormValue("message")), message); err != nil {
+		return fmt.Errorf("field message not valid: %w", err)
+	}
+
+	return nil
+}
+
+//Storing files of a multipart publish and referencing them from message, nothing is left stored on errors
+func (r *Receivers) storeAttachments(c *gin.Context, message *MessageData) error {
+
+	if c.Request.MultipartForm == nil {
+		return nil
+	}
+
+	defer c.Request.MultipartForm.RemoveAll()
+
+	files := c.Request.MultipartForm.File["attachments"]
+
+	if len(files) > config().AttachmentMaxCount {
+		return fmt.Errorf("at most %d attachments per message", config().AttachmentMaxCount)
+	}
+
+	//files would be stored and delivered in plaintext, members encrypt them into Data
+	if len(files) > 0 && r.eb.isPrivate(message.Topic) {
+		return errors.New("messages of private topics cannot have attachments, files must be encrypted into Data")
+	}
+
+	for _, file := range files {
+
+		if file.Size > config().AttachmentMaxBytes {
+			return fmt.Errorf("attachment %s larger than %d bytes", file.Filename, config().AttachmentMaxBytes)
+		}
+	}
+
+	for _, file := range files {
+
+		attachment, err := r.storeAttachment(c.Request.Context(), file)
+
+		if err != nil {
+
+			r.deleteAttachments(*message)
+			message.Attachments = nil
+
+			return err
+		}
+
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	return nil
+}
+
+func (r *Receivers) storeAttachment(ctx context.Context, file *multipart.FileHeader) (Attachment, error) {
+
+	content, err := file.Open()
+
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	defer content.Close()
+
+	contentType := file.Header.Get("Content-Type")
+
+	if _, _, err = mime.ParseMediaType(contentType); err != nil {
+		contentType = contentTypeBinary
+	}
+
+	attachment := Attachment{
+		ID:          uuid.NewV4().String(),
+		Name:        filepath.Base(file.Filename),
+		ContentType: contentType,
+	}
+
+	attachment.URL = "/attachments/" + attachment.ID
+	attachment.Size, err = r.blobs.Put(ctx, attachment.ID, contentType, content)
+
+	if err != nil {
+
+		blobErrors.WithLabelValues("put").Inc()
+		return Attachment{}, fmt.Errorf("attachment %s not stored: %w", file.Filename, err)
+	}
+
+	return attachment, nil
+}
+
+//Deleting attachments of messages from the blob store, failures are logged and the blobs left behind
+func (r *Receivers) deleteAttachments(messages ...MessageData) {
+
+	if r.blobs == nil {
+		return
+	}
+
+	for _, message := range messages {
+
+		for _, attachment := range message.Attachments {
+
+			if err := r.blobs.Delete(context.Background(), attachment.ID); err != nil {
+
+				blobErrors.WithLabelValues("delete").Inc()
+				slog.Warn("attachment not deleted", "message_id", message.ID, "attachment", attachment.ID, "error", err)
+			}
+		}
+	}
+}
+
+//Getting the active message referencing attachment id, blobs of other messages are deleted or about to be
+func (eb *EventBroker) attachmentOwner(id string) (MessageData, bool) {
+
+	for _, q := range eb.topicQueues() {
+
+		q.rm.RLock()
+
+		for _, p := range q.partitions {
+
+			p.rm.RLock()
+
+			for _, message := range p.messages {
+
+				for _, attachment := range message.Attachments {
+
+					if attachment.ID == id {
+
+						p.rm.RUnlock()
+						q.rm.RUnlock()
+
+						return message, true
+					}
+				}
+			}
+
+			p.rm.RUnlock()
+		}
+
+		q.rm.RUnlock()
+	}
+
+	return MessageData{}, false
+}
+
+//Serving content of an attachment to users who can read its message until it expires. Attachments of other messages
+//are answered as missing, so that users cannot learn which blobs exist
+func (r *Receivers) attachment(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	message, found := r.eb.attachmentOwner(c.Param("id"))
+
+	if !found || !time.Now().Local().Before(message.ExpirationTime) || !r.eb.canAccess(message.Topic, email) {
+
+		c.JSON(http.StatusNotFound, "attachment not found")
+		return
+	}
+
+	content, contentType, err := r.blobs.Get(c.Request.Context(), c.Param("id"))
+
+	if errors.Is(err, errBlobNotFound) {
+
+		c.JSON(http.StatusNotFound, "attachment not found")
+		return
+	}
+
+	if err != nil {
+
+		blobErrors.WithLabelValues("get").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	defer content.Close()
+
+	if contentType == "" {
+		contentType = contentTypeBinary
+	}
+
+	//attachments are uploaded by users: photos are shown, anything else is downloaded and never rendered as a broker page
+	disposition := "attachment"
+
+	if stringInSlice(contentType, []string{"image/png", "image/jpeg", "image/gif", "image/webp"}) {
+		disposition = "inline"
+	}
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Disposition", disposition)
+	c.Header("Cache-Control", "private")
+
+	c.DataFromReader(http.StatusOK, -1, contentType, content, nil)
+}
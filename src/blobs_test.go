@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+//Gin context of a multipart publish of message with one file
+func multipartPublish(t *testing.T, message string) *gin.Context {
+
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	if err := form.WriteField("message", message); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := form.CreateFormFile("attachments", "notes.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = file.Write([]byte("meeting in room 4"))
+
+	if err = form.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/publish", &body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+
+	return c
+}
+
+func TestStoreAttachments(t *testing.T) {
+
+	cfg, _, _, err := parseConfig([]string{"-log-sinks=stdout", "-log-level=error"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentConfig.Store(cfg)
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+	r := &Receivers{eb: newEventBroker(), blobs: &localBlobStore{dir: dir}}
+	r.eb.defineTopic(TopicDefinition{Name: "private", Private: true, Members: []string{"alice@example.com"}})
+	r.eb.defineTopic(TopicDefinition{Name: "public"})
+
+	tests := []struct {
+		topic  string
+		stored int
+	}{
+		//files of private topics would be stored and delivered in plaintext
+		{topic: "private", stored: 0},
+		{topic: "public", stored: 1},
+	}
+
+	for _, test := range tests {
+
+		t.Run(test.topic, func(t *testing.T) {
+
+			c := multipartPublish(t, `{"Topic": "`+test.topic+`"}`)
+
+			var message MessageData
+
+			if err := readMultipartMessage(c, &message); err != nil {
+				t.Fatal(err)
+			}
+
+			err := r.storeAttachments(c, &message)
+
+			if (err != nil) != (test.stored == 0) || len(message.Attachments) != test.stored {
+				t.Fatalf("expected %d attachments stored, got %d (error %v)", test.stored, len(message.Attachments), err)
+			}
+
+			r.deleteAttachments(message)
+
+			if files, _ := os.ReadDir(dir); len(files) != 0 {
+				t.Fatalf("blobs left in store: %d", len(files))
+			}
+		})
+	}
+}
+
+func TestAttachmentOwner(t *testing.T) {
+
+	cfg, _, _, err := parseConfig([]string{"-log-sinks=stdout", "-log-level=error"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentConfig.Store(cfg)
+
+	r := &Receivers{eb: newEventBroker()}
+	now := time.Now().Local()
+
+	message := MessageData{ID: "message-1", Topic: "public", InsertionTime: now, ExpirationTime: now.Add(time.Hour),
+		Attachments: []Attachment{{ID: "blob-1"}}}
+
+	r.publishTo(&message)
+
+	if owner, found := r.eb.attachmentOwner("blob-1"); !found || owner.ID != message.ID {
+		t.Fatalf("expected message-1 to own blob-1, got %+v", owner)
+	}
+
+	if _, found := r.eb.attachmentOwner("blob-2"); found {
+		t.Fatal("blob of no message found")
+	}
+
+	//blobs of messages no longer active are not served
+	r.eb.queue("public").removeMessages(func(MessageData) bool { return true })
+
+	if _, found := r.eb.attachmentOwner("blob-1"); found {
+		t.Fatal("blob of a removed message found")
+	}
+}
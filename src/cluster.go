@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Cluster event types
+const (
+	eventMessages      = "messages"       //messages accepted by the topic owner
+	eventSubscriptions = "subscriptions"  //subscriptions of a user changed in db
+	eventWebhooks      = "webhooks"       //webhooks changed in db
+	eventRemoveRequest = "remove-request" //exactly-once request completed by the client
+	eventTopics        = "topics"         //topics changed in db
+	eventRead          = "read"           //messages read through another node, sent to the owner of their topic
+)
+
+//Topics are owned by the Raft leader: the owner assigns offsets, persists, deduplicates requests and calls webhooks, then
+//replicates accepted messages to the other nodes with its Raft term, so that nodes can refuse messages of deposed owners
+type cluster struct {
+	r      *Receivers
+	self   string
+	nodes  map[string]bool //key: node url - value: alive
+	term   uint64          //highest term of the owners messages were received from
+	client *http.Client
+	rm     sync.RWMutex
+}
+
+type ClusterEvent struct {
+	Type       string        `json:"Type"`
+	Messages   []MessageData `json:"Messages,omitempty"`
+	Subscriber string        `json:"Subscriber,omitempty"`
+	RequestID  string        `json:"RequestID,omitempty"`
+	Term       uint64        `json:"Term,omitempty"` //Raft term of the owner sending messages
+	MessageIDs []string      `json:"MessageIDs,omitempty"`
+}
+
+type ClusterPublish struct {
+	Message  MessageData `json:"Message"`
+	Semantic string      `json:"Semantic"`
+}
+
+//Returned by call when the peer answered with an error status
+var errNodeAnswered = errors.New("cluster node answered with error")
+
+//Last offset of every topic, used by owners to send missed messages
+type ClusterState struct {
+	Offsets map[string]int64 `json:"Offsets"`
+}
+
+//Joining nodes listed in cluster-nodes and their Raft group, replicating accepted messages and probing peers
+func (r *Receivers) initCluster() {
+
+	if !config().ClusterEnabled {
+		return
+	}
+
+	c := &cluster{
+		r:      r,
+		self:   strings.TrimSuffix(config().ClusterAdvertiseURL, "/"),
+		nodes:  map[string]bool{},
+		client: &http.Client{Timeout: time.Millisecond * time.Duration(config().ClusterTimeout)},
+	}
+
+	for _, node := range strings.Split(config().ClusterNodes, ",") {
+
+		if node = strings.TrimSuffix(strings.TrimSpace(node), "/"); node != "" {
+			c.nodes[node] = true
+		}
+	}
+
+	c.nodes[c.self] = true
+	r.cluster = c
+
+	//owners are elected by Raft, which must run before messages are accepted or peers probed
+	r.initRaft()
+	r.eb.addListener(c.replicate)
+
+	if backgroundWorkers.start() {
+		go c.probe()
+	}
+
+	slog.Info("cluster joined", "node", c.self, "nodes", len(c.nodes))
+}
+
+//Getting owner of topic as known by this node, empty while no leader is elected. Nodes seeing different live peers would
+//choose different owners, while a single Raft leader is elected by a majority
+func (c *cluster) owner(topic string) string {
+
+	_, leader := c.r.raft.raft.LeaderWithID()
+
+	return string(leader)
+}
+
+//Checking if this node owns topic, always true without cluster. A leader cut off from the majority steps down within the
+//Raft leader lease, before the others can elect a new one
+func (c *cluster) owns(topic string) bool {
+
+	return c == nil || c.r.raft.raft.State() == raft.Leader
+}
+
+//Checking that messages come from an owner not older than the ones already received from
+func (c *cluster) current(term uint64) bool {
+
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	if term < c.term {
+		return false
+	}
+
+	c.term = term
+
+	return true
+}
+
+func (c *cluster) setAlive(node string, alive bool) {
+
+	c.rm.Lock()
+	changed := c.nodes[node] != alive
+	c.nodes[node] = alive
+	c.rm.Unlock()
+
+	if changed {
+		slog.Warn("cluster node changed state", "node", node, "alive", alive)
+	}
+}
+
+func (c *cluster) peers() []string {
+
+	c.rm.RLock()
+	defer c.rm.RUnlock()
+
+	var peers []string
+
+	for node, alive := range c.nodes {
+
+		if alive && node != c.self {
+			peers = append(peers, node)
+		}
+	}
+
+	return peers
+}
+
+//Sending a request to a peer with the cluster secret, decoding the JSON response into result if not nil
+func (c *cluster) call(ctx context.Context, method string, node string, path string, body interface{}, result interface{}) error {
+
+	var payload []byte
+	var err error
+
+	if body != nil {
+
+		payload, err = json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, node+path, bytes.NewReader(payload))
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Cluster-Secret", config().ClusterSecret)
+	request.Header.Set("X-Cluster-Node", c.self)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	response, err := c.client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s%s %s", errNodeAnswered, node, path, response.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+//Publishing on the node owning the topic, failing while no owner is elected: the client will retry
+func (r *Receivers) routeMessage(ctx context.Context, message MessageData, semantic string) PublishResult {
+
+	if r.cluster.owns(message.Topic) {
+		return r.publishMessage(ctx, message, semantic)
+	}
+
+	owner := r.cluster.owner(message.Topic)
+
+	if owner == "" || owner == r.cluster.self {
+
+		loggerFrom(ctx).Warn("message not forwarded", "error", errNoLeader)
+		return PublishResult{Result: "fail"}
+	}
+
+	var result PublishResult
+	err := r.cluster.call(ctx, http.MethodPost, owner, "/internal/publish", ClusterPublish{message, semantic}, &result)
+
+	if err != nil {
+
+		loggerFrom(ctx).Warn("message not forwarded", "node", owner, "error", err)
+
+		//a node answering with an error is alive
+		if !errors.Is(err, errNodeAnswered) && ctx.Err() == nil {
+			r.cluster.setAlive(owner, false)
+		}
+
+		return PublishResult{Result: "fail"}
+	}
+
+	return result
+}
+
+//Sending accepted message to the other nodes, missed messages are sent again by probe
+func (c *cluster) replicate(message MessageData) {
+
+	c.broadcast(ClusterEvent{Type: eventMessages, Messages: []MessageData{message}, Term: c.r.raft.term()})
+}
+
+//Sending event to live peers in background
+func (c *cluster) broadcast(event ClusterEvent) {
+
+	if c == nil {
+		return
+	}
+
+	for _, peer := range c.peers() {
+
+		if !backgroundWorkers.start() {
+			return
+		}
+
+		go func(peer string) {
+
+			defer backgroundWorkers.done()
+
+			err := c.call(context.Background(), http.MethodPost, peer, "/internal/replicate", event, nil)
+
+			if err != nil {
+
+				slog.Warn("cluster event not delivered", "node", peer, "type", event.Type, "error", err)
+				c.setAlive(peer, false)
+			}
+		}(peer)
+	}
+}
+
+//Sending read marks of messages to the owners of their topics, which decide on dead-lettering them when they expire
+func (c *cluster) sendRead(messages MessageDataSlice) {
+
+	if c == nil {
+		return
+	}
+
+	byOwner := map[string][]string{}
+
+	for _, message := range messages {
+
+		if owner := c.owner(message.Topic); owner != "" && owner != c.self {
+			byOwner[owner] = append(byOwner[owner], message.ID)
+		}
+	}
+
+	for owner, ids := range byOwner {
+
+		if !backgroundWorkers.start() {
+			return
+		}
+
+		go func(owner string, ids []string) {
+
+			defer backgroundWorkers.done()
+
+			event := ClusterEvent{Type: eventRead, MessageIDs: ids}
+
+			if err := c.call(context.Background(), http.MethodPost, owner, "/internal/replicate", event, nil); err != nil {
+				slog.Warn("read marks not sent to topic owner", "node", owner, "messages", len(ids), "error", err)
+			}
+		}(owner, ids)
+	}
+}
+
+//Checking peers periodically, sending them messages of owned topics they missed
+func (c *cluster) probe() {
+
+	defer backgroundWorkers.done()
+
+	for {
+
+		c.rm.RLock()
+
+		var nodes []string
+
+		for node := range c.nodes {
+
+			if node != c.self {
+				nodes = append(nodes, node)
+			}
+		}
+
+		c.rm.RUnlock()
+
+		for _, node := range nodes {
+
+			var state ClusterState
+			err := c.call(context.Background(), http.MethodGet, node, "/internal/state", nil, &state)
+
+			c.setAlive(node, err == nil)
+
+			if err == nil {
+				c.sync(node, state)
+			}
+		}
+
+		if !sleepOrShutdown(time.Second * time.Duration(config().ClusterProbeInterval)) {
+			return
+		}
+	}
+}
+
+//Sending to node the messages of owned topics after its last offsets
+func (c *cluster) sync(node string, state ClusterState) {
+
+	var missed []MessageData
+
+	for topic, q := range c.r.eb.topicQueues() {
+
+		if q.offset.Load() <= state.Offsets[topic] {
+			continue
+		}
+
+		for _, message := range c.r.eb.logMessages(topic) {
+
+			if message.Offset > state.Offsets[topic] {
+				missed = append(missed, message)
+			}
+		}
+	}
+
+	var owned []MessageData
+
+	for _, message := range missed {
+
+		if c.owns(message.Topic) {
+			owned = append(owned, message)
+		}
+	}
+
+	if len(owned) == 0 {
+		return
+	}
+
+	event := ClusterEvent{Type: eventMessages, Messages: owned, Term: c.r.raft.term()}
+	err := c.call(context.Background(), http.MethodPost, node, "/internal/replicate", event, nil)
+
+	if err != nil {
+
+		slog.Warn("missed messages not sent", "node", node, "messages", len(owned), "error", err)
+		return
+	}
+
+	slog.Info("missed messages sent", "node", node, "messages", len(owned))
+}
+
+//Accepting only requests carrying the cluster secret
+func ClusterMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		secret := config().ClusterSecret
+
+		if !config().ClusterEnabled || subtle.ConstantTimeCompare([]byte(c.GetHeader("X-Cluster-Secret")), []byte(secret)) != 1 {
+
+			c.AbortWithStatusJSON(http.StatusForbidden, "Not a cluster node")
+			return
+		}
+
+		withLogFields(c, "cluster_node", c.GetHeader("X-Cluster-Node"))
+		c.Next()
+	}
+}
+
+//Publishing a message forwarded by another node, without forwarding it again
+func (r *Receivers) internalPublish(c *gin.Context) {
+
+	var request ClusterPublish
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	withLogFields(c, "topic", request.Message.Topic)
+
+	//leadership may have changed since the sender looked up the owner
+	if !r.cluster.owns(request.Message.Topic) {
+
+		c.JSON(http.StatusConflict, "Not the topic owner")
+		return
+	}
+
+	c.JSON(http.StatusOK, r.publishMessage(c.Request.Context(), request.Message, request.Semantic))
+}
+
+//Applying an event sent by another node
+func (r *Receivers) internalReplicate(c *gin.Context) {
+
+	var event ClusterEvent
+	err := json.NewDecoder(c.Request.Body).Decode(&event)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	switch event.Type {
+
+	case eventMessages:
+
+		if !r.cluster.current(event.Term) {
+
+			c.JSON(http.StatusConflict, "Messages of a deposed owner")
+			return
+		}
+
+		for _, message := range event.Messages {
+
+			if r.mergeMessage(message) && r.mqtt != nil {
+				r.mqtt.dispatch(message)
+			}
+		}
+
+	case eventSubscriptions:
+		err = r.reloadSubscriptions(event.Subscriber)
+
+	case eventWebhooks:
+		err = r.hooks.load()
+
+	case eventTopics:
+		err = r.loadTopics()
+
+	case eventRemoveRequest:
+		r.eb.deleteRequest(event.RequestID)
+
+	case eventRead:
+		r.eb.markRead(event.MessageIDs)
+
+	default:
+		c.JSON(http.StatusBadRequest, "Unknown event "+event.Type)
+		return
+	}
+
+	if err != nil {
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, "ok")
+}
+
+//Getting last offsets of this node
+func (r *Receivers) internalState(c *gin.Context) {
+
+	state := ClusterState{Offsets: map[string]int64{}}
+
+	for topic, q := range r.eb.topicQueues() {
+		state.Offsets[topic] = q.offset.Load()
+	}
+
+	c.JSON(http.StatusOK, state)
+}
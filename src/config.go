@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/magiconair/properties"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//Settings are read, in increasing priority, from defaults, properties file, SDCC_* environment variables and flags.
+//Keys are the ones of conf.properties: delivery-semantic is set by SDCC_DELIVERY_SEMANTIC or -delivery-semantic.
+//Settings tagged reload are applied by reloadConfig, the others require a restart
+type Config struct {
+
+	//broker
+	AppListeningPort       string `properties:"app-listening-port,default=8080"`
+	DBPersistence          bool   `properties:"db-persistence,default=true"`
+	DeliverySemantic       string `properties:"delivery-semantic,default=at-least-once"`
+	GarbageCollectorPeriod int    `properties:"garbage-collector-period,default=1,reload"`
+	EliminationPeriod      int    `properties:"elimination-period,default=1,reload"`
+	RequestLifetime        int    `properties:"request-lifetime,default=2,reload"`
+	DeliveryTimeout        int    `properties:"delivery-timeout,default=100,reload"`
+	RetryLimit             int    `properties:"retry-limit,default=5,reload"`
+	MessageRetention       int    `properties:"message-retention,default=0,reload"`
+	ReplayLimit            int    `properties:"replay-limit,default=1000,reload"`
+	DeadLetterLimit        int    `properties:"dead-letter-limit,default=1000,reload"`
+	TopicPartitions        int    `properties:"topic-partitions,default=1"`
+	TopicMaxLifetime       int    `properties:"topic-max-lifetime,default=0,reload"`
+	TopicMaxMessages       int    `properties:"topic-max-messages,default=0,reload"`
+	TopicMaxBytes          int64  `properties:"topic-max-bytes,default=0,reload"`
+	TopicOverflowPolicy    string `properties:"topic-overflow-policy,default=reject,reload"`
+	TopicMaxRadius         int    `properties:"topic-max-radius,default=0,reload"`
+	PartitionPrecision     int    `properties:"partition-geohash-precision,default=5"`
+	DeadLetterExpired      bool   `properties:"dead-letter-expired,default=false,reload"`
+	SearchBackend          string `properties:"search-backend,default=memory"`
+	SearchLimit            int    `properties:"search-limit,default=100,reload"`
+
+	//attachments
+	BlobStore          string `properties:"blob-store,default=local"`
+	BlobDir            string `properties:"blob-dir,default=../data/blobs"`
+	AttachmentMaxCount int    `properties:"attachment-max-count,default=5,reload"`
+	AttachmentMaxBytes int64  `properties:"attachment-max-bytes,default=10485760,reload"`
+
+	//sessions
+	TokenExpirationTime int    `properties:"token-expiration-time,default=15,reload"`
+	AccessSecret        string `properties:"access-secret,default=jdnfksdmfksd,secret"`
+	AdminUsers          string `properties:"admin-users,default=,reload"`
+
+	//rate limits, rates are publishes per second (0 disables a limit)
+	RateLimitEnabled     bool    `properties:"rate-limit-enabled,default=false,reload"`
+	RateLimitUser        float64 `properties:"rate-limit-user,default=5,reload"`
+	RateLimitUserBurst   int     `properties:"rate-limit-user-burst,default=20,reload"`
+	RateLimitAPIKey      float64 `properties:"rate-limit-api-key,default=0,reload"`
+	RateLimitAPIKeyBurst int     `properties:"rate-limit-api-key-burst,default=20,reload"`
+	RateLimitTopic       float64 `properties:"rate-limit-topic,default=50,reload"`
+	RateLimitTopicBurst  int     `properties:"rate-limit-topic-burst,default=200,reload"`
+	DailyQuotas          string  `properties:"daily-quotas,default=,reload"`
+
+	//Postgres and Redis
+	PostgresHost        string `properties:"postgres-host,default=172.28.1.3"`
+	PostgresPort        int    `properties:"postgres-port,default=5432"`
+	PostgresUser        string `properties:"postgres-user,default=postgres"`
+	PostgresPassword    string `properties:"postgres-password,default=password,secret"`
+	PostgresDatabase    string `properties:"postgres-database,default=sdcc"`
+	PostgresSSLMode     string `properties:"postgres-sslmode,default=disable"`
+	PostgresAutoMigrate bool   `properties:"postgres-auto-migrate,default=true"`
+	PostGISEnabled      bool   `properties:"postgis-enabled,default=false"`
+	RedisAddress        string `properties:"redis-address,default=localhost:6379"`
+	RedisPassword       string `properties:"redis-password,default=empires,secret"`
+	RedisFanoutEnabled  bool   `properties:"redis-fanout-enabled,default=false"`
+	RedisFanoutChannel  string `properties:"redis-fanout-channel,default=sdcc:messages"`
+	StartupRetryLimit   int    `properties:"startup-retry-limit,default=10"`
+	StartupRetryBackoff int    `properties:"startup-retry-backoff,default=500"`
+	ShutdownTimeout     int    `properties:"shutdown-timeout,default=30,reload"`
+
+	//MQTT
+	MQTTEnabled         bool   `properties:"mqtt-enabled,default=false"`
+	MQTTListeningPort   string `properties:"mqtt-listening-port,default=1883"`
+	MQTTDefaultLifetime int    `properties:"mqtt-default-lifetime,default=60"`
+	MQTTDefaultRadius   int    `properties:"mqtt-default-radius,default=20000"`
+	MQTTMaxPacketSize   int    `properties:"mqtt-max-packet-size,default=1048576"`
+
+	//webhooks
+	WebhookRetryLimit      int    `properties:"webhook-retry-limit,default=5,reload"`
+	WebhookBackoff         int    `properties:"webhook-backoff,default=500,reload"`
+	WebhookTimeout         int    `properties:"webhook-timeout,default=5000"`
+	WebhookDeadLetterLimit int64  `properties:"webhook-dead-letter-limit,default=1000,reload"`
+	WebhookAllowedHosts    string `properties:"webhook-allowed-hosts,default=,reload"`
+
+	//cluster
+	ClusterEnabled       bool   `properties:"cluster-enabled,default=false"`
+	ClusterAdvertiseURL  string `properties:"cluster-advertise-url,default="`
+	ClusterNodes         string `properties:"cluster-nodes,default="`
+	ClusterSecret        string `properties:"cluster-secret,default=,secret"`
+	ClusterTimeout       int    `properties:"cluster-timeout,default=2000"`
+	ClusterProbeInterval int    `properties:"cluster-probe-interval,default=5,reload"`
+
+	//raft
+	RaftEnabled          bool   `properties:"raft-enabled,default=false"`
+	RaftBindAddress      string `properties:"raft-bind-address,default=127.0.0.1:7000"`
+	RaftAdvertiseAddress string `properties:"raft-advertise-address,default="`
+	RaftDataDir          string `properties:"raft-data-dir,default=../data/raft"`
+	RaftBootstrap        bool   `properties:"raft-bootstrap,default=false"`
+	RaftPeers            string `properties:"raft-peers,default="`
+	RaftApplyTimeout     int    `properties:"raft-apply-timeout,default=5000,reload"`
+
+	//tracing
+	TracingExporter    string  `properties:"tracing-exporter,default=none"`
+	TracingEndpoint    string  `properties:"tracing-otlp-endpoint,default=localhost:4318"`
+	TracingInsecure    bool    `properties:"tracing-otlp-insecure,default=true"`
+	TracingSampleRatio float64 `properties:"tracing-sample-ratio,default=1"`
+	TracingServiceName string  `properties:"tracing-service-name,default=sdcc"`
+
+	//logging
+	LogLevel      string `properties:"log-level,default=info,reload"`
+	LogFormat     string `properties:"log-format,default=json"`
+	LogSinks      string `properties:"log-sinks,default=file"`
+	LogFile       string `properties:"log-file,default=../log/server.log"`
+	LogMaxSize    int    `properties:"log-max-size,default=100"`
+	LogMaxBackups int    `properties:"log-max-backups,default=5"`
+	LogMaxAge     int    `properties:"log-max-age,default=30"`
+	LogCompress   bool   `properties:"log-compress,default=false"`
+}
+
+const defaultConfigFile = "../conf.properties"
+const envPrefix = "SDCC_"
+
+//Environment variables used before the unified configuration
+var legacyEnv = map[string]string{
+	"REDIS_DSN":     "redis-address",
+	"ACCESS_SECRET": "access-secret",
+}
+
+//Replaced as a whole on reload, never modified in place
+var currentConfig atomic.Pointer[Config]
+
+//Command-line arguments, parsed again on reload
+var configArgs []string
+
+//Getting current configuration
+func config() *Config {
+
+	return currentConfig.Load()
+}
+
+//Loading configuration from file, environment and flags, exiting on invalid settings or after --print-config.
+//Returns arguments following the flags
+func loadConfig(args []string) []string {
+
+	cfg, printConfig, rest, err := parseConfig(args)
+
+	if err != nil {
+
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+
+		cfg.write(os.Stdout)
+		os.Exit(0)
+	}
+
+	configArgs = args
+	currentConfig.Store(cfg)
+
+	return rest
+}
+
+func parseConfig(args []string) (*Config, bool, []string, error) {
+
+	keys := configKeys()
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	file := flags.String("config", "", "properties file (default "+defaultConfigFile+", env "+envPrefix+"CONFIG)")
+	printConfig := flags.Bool("print-config", false, "print the resulting configuration and exit")
+
+	for _, key := range keys {
+		flags.String(key.name, "", "overrides "+key.name+" (env "+envName(key.name)+")")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, false, nil, err
+	}
+
+	path, explicit := *file, true
+
+	if path == "" {
+		path, explicit = os.LookupEnv(envPrefix + "CONFIG")
+	}
+
+	if path == "" {
+		path = defaultConfigFile
+	}
+
+	p, err := properties.LoadFile(path, properties.UTF8)
+
+	if err != nil {
+
+		if explicit || !os.IsNotExist(err) {
+			return nil, false, nil, err
+		}
+
+		p = properties.NewProperties()
+	}
+
+	//values are taken literally, passwords may contain ${
+	p.DisableExpansion = true
+
+	for variable, key := range legacyEnv {
+
+		if value, found := os.LookupEnv(variable); found {
+			p.MustSet(key, value)
+		}
+	}
+
+	for _, key := range keys {
+
+		if value, found := os.LookupEnv(envName(key.name)); found {
+			p.MustSet(key.name, value)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+
+		if f.Name != "config" && f.Name != "print-config" {
+			p.MustSet(f.Name, f.Value.String())
+		}
+	})
+
+	cfg := &Config{}
+
+	if err := p.Decode(cfg); err != nil {
+		return nil, false, nil, err
+	}
+
+	return cfg, *printConfig, flags.Args(), cfg.validate()
+}
+
+//Checking values, all invalid settings are reported together
+func (c *Config) validate() error {
+
+	var errs []error
+
+	check := func(ok bool, key string, value interface{}, expected string) {
+
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s=%v: %s", key, value, expected))
+		}
+	}
+
+	check(stringInSlice(c.DeliverySemantic, []string{"at-most-once", "at-least-once", "exactly-once"}), "delivery-semantic",
+		c.DeliverySemantic, "expected at-most-once, at-least-once or exactly-once")
+	check(validPort(c.AppListeningPort), "app-listening-port", c.AppListeningPort, "expected a port number")
+	check(c.GarbageCollectorPeriod > 0, "garbage-collector-period", c.GarbageCollectorPeriod, "must be positive")
+	check(c.EliminationPeriod > 0, "elimination-period", c.EliminationPeriod, "must be positive")
+	check(c.RequestLifetime > 0, "request-lifetime", c.RequestLifetime, "must be positive")
+	check(c.DeliveryTimeout > 0, "delivery-timeout", c.DeliveryTimeout, "must be positive")
+	check(c.RetryLimit > 0, "retry-limit", c.RetryLimit, "must be positive")
+	check(c.MessageRetention >= 0, "message-retention", c.MessageRetention, "must not be negative")
+	check(c.ReplayLimit > 0, "replay-limit", c.ReplayLimit, "must be positive")
+	check(c.DeadLetterLimit > 0, "dead-letter-limit", c.DeadLetterLimit, "must be positive")
+	check(c.TopicPartitions > 0, "topic-partitions", c.TopicPartitions, "must be positive")
+	check(c.TopicMaxLifetime >= 0, "topic-max-lifetime", c.TopicMaxLifetime, "must not be negative")
+	check(c.TopicMaxMessages >= 0, "topic-max-messages", c.TopicMaxMessages, "must not be negative")
+	check(c.TopicMaxBytes >= 0, "topic-max-bytes", c.TopicMaxBytes, "must not be negative")
+	check(c.TopicMaxRadius >= 0, "topic-max-radius", c.TopicMaxRadius, "must not be negative")
+	check(validOverflowPolicy(c.TopicOverflowPolicy), "topic-overflow-policy", c.TopicOverflowPolicy, "expected reject or drop-oldest")
+	check(c.PartitionPrecision > 0 && c.PartitionPrecision <= 12, "partition-geohash-precision", c.PartitionPrecision,
+		"expected a value between 1 and 12")
+
+	check(c.SearchBackend == "memory" || c.SearchBackend == "postgres", "search-backend", c.SearchBackend,
+		"expected memory or postgres")
+	check(c.SearchBackend != "postgres" || c.DBPersistence, "search-backend", c.SearchBackend, "postgres requires db-persistence=true")
+	check(c.SearchLimit > 0, "search-limit", c.SearchLimit, "must be positive")
+
+	check(c.BlobStore == "local", "blob-store", c.BlobStore, "expected local")
+	check(c.BlobDir != "", "blob-dir", "", "must not be empty")
+	check(c.AttachmentMaxCount >= 0, "attachment-max-count", c.AttachmentMaxCount, "must not be negative")
+	check(c.AttachmentMaxBytes > 0, "attachment-max-bytes", c.AttachmentMaxBytes, "must be positive")
+
+	check(c.TokenExpirationTime > 0, "token-expiration-time", c.TokenExpirationTime, "must be positive")
+	check(c.AccessSecret != "", "access-secret", "", "must not be empty")
+
+	check(c.RateLimitUser >= 0 && c.RateLimitAPIKey >= 0 && c.RateLimitTopic >= 0, "rate-limit-user/api-key/topic",
+		fmt.Sprint(c.RateLimitUser, "/", c.RateLimitAPIKey, "/", c.RateLimitTopic), "must not be negative")
+	check(c.RateLimitUserBurst >= 0 && c.RateLimitAPIKeyBurst >= 0 && c.RateLimitTopicBurst >= 0,
+		"rate-limit-user/api-key/topic-burst", fmt.Sprint(c.RateLimitUserBurst, "/", c.RateLimitAPIKeyBurst, "/",
+			c.RateLimitTopicBurst), "must not be negative")
+	_, err := dailyQuotas(c.DailyQuotas)
+	check(err == nil, "daily-quotas", c.DailyQuotas, "expected comma separated admin=<publishes> and/or user=<publishes>")
+
+	check(!c.PostGISEnabled || c.DBPersistence, "postgis-enabled", c.PostGISEnabled, "requires db-persistence=true")
+	check(c.PostgresPort > 0 && c.PostgresPort <= 65535, "postgres-port", c.PostgresPort, "expected a port number")
+	check(c.RedisAddress != "", "redis-address", "", "must not be empty")
+
+	if c.RedisFanoutEnabled {
+
+		check(c.RedisFanoutChannel != "", "redis-fanout-channel", "", "must not be empty")
+		check(!c.ClusterEnabled, "redis-fanout-enabled", c.RedisFanoutEnabled, "cluster-enabled already replicates messages")
+	}
+
+	check(c.StartupRetryLimit > 0, "startup-retry-limit", c.StartupRetryLimit, "must be positive")
+	check(c.StartupRetryBackoff >= 0, "startup-retry-backoff", c.StartupRetryBackoff, "must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown-timeout", c.ShutdownTimeout, "must be positive")
+
+	check(validPort(c.MQTTListeningPort), "mqtt-listening-port", c.MQTTListeningPort, "expected a port number")
+	check(c.MQTTDefaultLifetime > 0, "mqtt-default-lifetime", c.MQTTDefaultLifetime, "must be positive")
+	check(c.MQTTDefaultRadius > 0, "mqtt-default-radius", c.MQTTDefaultRadius, "must be positive")
+	check(c.MQTTMaxPacketSize >= mqttConnectMaxSize && c.MQTTMaxPacketSize <= 268435460, "mqtt-max-packet-size",
+		c.MQTTMaxPacketSize, fmt.Sprintf("expected %d to 268435460 bytes", mqttConnectMaxSize))
+
+	check(c.WebhookRetryLimit >= 0, "webhook-retry-limit", c.WebhookRetryLimit, "must not be negative")
+	check(c.WebhookBackoff >= 0, "webhook-backoff", c.WebhookBackoff, "must not be negative")
+	check(c.WebhookTimeout > 0, "webhook-timeout", c.WebhookTimeout, "must be positive")
+	check(c.WebhookDeadLetterLimit > 0, "webhook-dead-letter-limit", c.WebhookDeadLetterLimit, "must be positive")
+
+	if c.ClusterEnabled {
+
+		check(strings.HasPrefix(c.ClusterAdvertiseURL, "http"), "cluster-advertise-url", c.ClusterAdvertiseURL,
+			"expected the URL other nodes use to reach this one")
+		check(c.ClusterNodes != "", "cluster-nodes", "", "expected comma separated URLs of cluster nodes")
+		check(c.ClusterSecret != "", "cluster-secret", "", "must not be empty")
+		check(c.RaftEnabled, "cluster-enabled", c.ClusterEnabled, "requires raft-enabled to elect topic owners")
+	}
+
+	check(c.ClusterTimeout > 0, "cluster-timeout", c.ClusterTimeout, "must be positive")
+	check(c.ClusterProbeInterval > 0, "cluster-probe-interval", c.ClusterProbeInterval, "must be positive")
+
+	if c.RaftEnabled {
+
+		check(c.ClusterEnabled, "raft-enabled", c.RaftEnabled, "requires cluster-enabled")
+		check(c.RaftBindAddress != "", "raft-bind-address", "", "expected host:port")
+		check(c.RaftDataDir != "", "raft-data-dir", "", "must not be empty")
+		_, err := raftPeers(c.RaftPeers)
+		check(err == nil, "raft-peers", c.RaftPeers, "expected comma separated <node url>=<raft address>")
+	}
+
+	check(c.RaftApplyTimeout > 0, "raft-apply-timeout", c.RaftApplyTimeout, "must be positive")
+
+	check(stringInSlice(c.TracingExporter, []string{"none", "stdout", "otlp"}), "tracing-exporter", c.TracingExporter,
+		"expected none, stdout or otlp")
+	check(c.TracingSampleRatio >= 0 && c.TracingSampleRatio <= 1, "tracing-sample-ratio", c.TracingSampleRatio,
+		"expected a value between 0 and 1")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log-level", c.LogLevel, "expected debug, info, warn or error")
+	check(c.LogFormat == "json" || c.LogFormat == "text", "log-format", c.LogFormat, "expected json or text")
+
+	for _, sink := range strings.Split(c.LogSinks, ",") {
+		check(stringInSlice(strings.TrimSpace(sink), []string{"file", "stdout", "stderr"}), "log-sinks", c.LogSinks,
+			"expected file, stdout and/or stderr")
+	}
+
+	check(c.LogMaxSize >= 0 && c.LogMaxBackups >= 0 && c.LogMaxAge >= 0, "log-max-size/backups/age",
+		fmt.Sprint(c.LogMaxSize, "/", c.LogMaxBackups, "/", c.LogMaxAge), "must not be negative")
+
+	return errors.Join(errs...)
+}
+
+//Getting administrators from the comma separated admin-users setting
+func (c *Config) adminUsers() []string {
+
+	return strings.Split(strings.ReplaceAll(c.AdminUsers, " ", ""), ",")
+}
+
+//Getting hosts webhooks may reach on internal addresses, from the comma separated webhook-allowed-hosts setting
+func (c *Config) webhookAllowedHosts() []string {
+
+	return strings.Split(strings.ReplaceAll(strings.ToLower(c.WebhookAllowedHosts), " ", ""), ",")
+}
+
+//Writing configuration in properties format, secrets are masked
+func (c *Config) write(out io.Writer) {
+
+	value := reflect.ValueOf(c).Elem()
+
+	for i, key := range configKeys() {
+
+		setting := fmt.Sprint(value.Field(i).Interface())
+
+		if key.secret && setting != "" {
+			setting = "********"
+		}
+
+		fmt.Fprintf(out, "%s=%s\n", key.name, setting)
+	}
+}
+
+type configKey struct {
+	name   string
+	secret bool
+	reload bool
+}
+
+//Getting setting keys from the tags of Config, in field order
+func configKeys() []configKey {
+
+	t := reflect.TypeOf(Config{})
+	keys := make([]configKey, t.NumField())
+
+	for i := range keys {
+
+		tag := strings.Split(t.Field(i).Tag.Get("properties"), ",")
+		keys[i] = configKey{name: tag[0], secret: stringInSlice("secret", tag[1:]), reload: stringInSlice("reload", tag[1:])}
+	}
+
+	return keys
+}
+
+func envName(key string) string {
+
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+func validPort(port string) bool {
+
+	number, err := strconv.Atoi(port)
+
+	return err == nil && number > 0 && number <= 65535
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/twinj/uuid"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Reasons for parking a message in dead-letter queue
+const (
+	reasonPersistenceFailed = "persistence-failed"
+	reasonRejected          = "rejected"
+	reasonExpiredUnread     = "expired-unread"
+)
+
+type DeadLetter struct {
+	ID       string      `json:"ID"`
+	Reason   string      `json:"Reason"`
+	FailedAt time.Time   `json:"FailedAt"`
+	Message  MessageData `json:"Message"`
+}
+
+//Body of inspect, replay and purge requests, empty IDs means the whole topic
+type DeadLetterRequest struct {
+	Topic string   `json:"Topic"`
+	IDs   []string `json:"IDs"`
+}
+
+type deadLetterQueue struct {
+	letters map[string][]DeadLetter //key: topic - value: dead letters, oldest first
+	rm      sync.RWMutex
+}
+
+//Initializing dead-letter queue, loading it from db when persistence is enabled
+func (r *Receivers) initDeadLetters() {
+
+	r.dlq = &deadLetterQueue{letters: map[string][]DeadLetter{}}
+
+	if !config().DBPersistence {
+		return
+	}
+
+	if err := r.loadDeadLetters(); err != nil {
+		fatal("dead letters not loaded", err)
+	}
+}
+
+//Reading dead letters from db, the ones whose message cannot be decoded are skipped
+func (r *Receivers) loadDeadLetters() error {
+
+	rows, err := r.dbServer.db.Query(`SELECT id, reason, failed_at, message FROM dead_letters ORDER BY failed_at`)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var deadLetter DeadLetter
+		var message []byte
+
+		if err = rows.Scan(&deadLetter.ID, &deadLetter.Reason, &deadLetter.FailedAt, &message); err != nil {
+			return err
+		}
+
+		if err = json.Unmarshal(message, &deadLetter.Message); err != nil {
+
+			slog.Warn("dead letter skipped, message not decoded", "dead_letter", deadLetter.ID, "error", err)
+			continue
+		}
+
+		r.dlq.add(deadLetter)
+	}
+
+	return rows.Err()
+}
+
+//Parking message in dead-letter queue of its topic
+func (r *Receivers) deadLetter(message MessageData, reason string) {
+
+	deadLetter := DeadLetter{
+		ID:       uuid.NewV4().String(),
+		Reason:   reason,
+		FailedAt: time.Now().Local(),
+		Message:  message,
+	}
+
+	slog.Warn("message moved to dead-letter queue", "message", message.ID, "topic", message.Topic, "reason", reason)
+
+	dropped := r.dlq.add(deadLetter)
+
+	if config().DBPersistence {
+
+		payload, _ := json.Marshal(message)
+
+		_, err := r.dbServer.db.Exec(`INSERT INTO dead_letters (id, topic, reason, failed_at, message) VALUES ($1, $2, $3, $4, $5)`,
+			deadLetter.ID, message.Topic, reason, deadLetter.FailedAt, payload)
+
+		if err != nil {
+			dbErrors.WithLabelValues("insert-dead-letter").Inc()
+			slog.Error("dead letter not persisted", "topic", message.Topic, "error", err)
+		}
+
+		r.deleteDeadLettersFromDB(dropped)
+	}
+}
+
+//Adding dead letter, returning the ids dropped because of dead-letter-limit
+func (dlq *deadLetterQueue) add(deadLetter DeadLetter) []string {
+
+	dlq.rm.Lock()
+	defer dlq.rm.Unlock()
+
+	topic := deadLetter.Message.Topic
+	dlq.letters[topic] = append(dlq.letters[topic], deadLetter)
+
+	var dropped []string
+
+	for len(dlq.letters[topic]) > config().DeadLetterLimit {
+
+		dropped = append(dropped, dlq.letters[topic][0].ID)
+		dlq.letters[topic] = dlq.letters[topic][1:]
+	}
+
+	return dropped
+}
+
+//Getting dead letters of topic (all topics if empty) with given ids (all if empty)
+func (dlq *deadLetterQueue) find(topic string, ids []string) []DeadLetter {
+
+	dlq.rm.RLock()
+	defer dlq.rm.RUnlock()
+
+	results := []DeadLetter{}
+
+	for letterTopic, letters := range dlq.letters {
+
+		if topic != "" && letterTopic != topic {
+			continue
+		}
+
+		for _, deadLetter := range letters {
+
+			if len(ids) == 0 || stringInSlice(deadLetter.ID, ids) {
+				results = append(results, deadLetter)
+			}
+		}
+	}
+
+	return results
+}
+
+//Removing dead letters of topic with given ids (all if empty), returning removed ids
+func (dlq *deadLetterQueue) remove(topic string, ids []string) []string {
+
+	dlq.rm.Lock()
+	defer dlq.rm.Unlock()
+
+	removed := []string{}
+	var kept []DeadLetter
+
+	for _, deadLetter := range dlq.letters[topic] {
+
+		if len(ids) == 0 || stringInSlice(deadLetter.ID, ids) {
+
+			removed = append(removed, deadLetter.ID)
+
+		} else {
+
+			kept = append(kept, deadLetter)
+		}
+	}
+
+	dlq.letters[topic] = kept
+
+	return removed
+}
+
+func (r *Receivers) deleteDeadLettersFromDB(ids []string) {
+
+	for _, id := range ids {
+
+		_, err := r.dbServer.db.Exec(`DELETE FROM dead_letters WHERE id = $1`, id)
+
+		if err != nil {
+			dbErrors.WithLabelValues("delete-dead-letter").Inc()
+			slog.Error("dead letter not deleted from db", "id", id, "error", err)
+		}
+	}
+}
+
+//Inspecting dead-letter queue, optionally filtered by topic query parameter
+func (r *Receivers) deadLetters(c *gin.Context) {
+
+	c.JSON(http.StatusOK, r.dlq.find(c.Query("topic"), nil))
+}
+
+//Publishing dead letters again with at-least-once semantic, messages failing again go back to the queue
+func (r *Receivers) replayDeadLetters(c *gin.Context) {
+
+	var request DeadLetterRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if request.Topic == "" {
+
+		c.JSON(http.StatusBadRequest, "Topic is required")
+		return
+	}
+
+	deadLetters := r.dlq.find(request.Topic, request.IDs)
+	results := map[string]PublishResult{} //key: dead letter id - value: publish result
+
+	if len(deadLetters) == 0 {
+
+		c.JSON(http.StatusOK, results)
+		return
+	}
+
+	var ids []string
+
+	for _, deadLetter := range deadLetters {
+		ids = append(ids, deadLetter.ID)
+	}
+
+	removed := r.dlq.remove(request.Topic, ids)
+
+	if config().DBPersistence {
+		r.deleteDeadLettersFromDB(removed)
+	}
+
+	for _, deadLetter := range deadLetters {
+
+		message := deadLetter.Message
+		message.RequestID = ""
+
+		results[deadLetter.ID] = r.routeMessage(c.Request.Context(), message, "at-least-once")
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+//Deleting dead letters of a topic
+func (r *Receivers) purgeDeadLetters(c *gin.Context) {
+
+	var request DeadLetterRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if request.Topic == "" {
+
+		c.JSON(http.StatusBadRequest, "Topic is required")
+		return
+	}
+
+	removed := r.dlq.remove(request.Topic, request.IDs)
+
+	if config().DBPersistence {
+		r.deleteDeadLettersFromDB(removed)
+	}
+
+	c.JSON(http.StatusOK, removed)
+}
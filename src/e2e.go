@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"net/http"
+	"strconv"
+)
+
+//Algorithm of end-to-end encrypted messages: AES-256-GCM with the topic key, nonce prepended to the ciphertext in Data
+const encryptionAlgorithm = "A256GCM"
+
+//Length of X25519 public keys and of topic keys sealed to them (key, ephemeral public key and authenticator)
+const (
+	publicKeyLength  = 32
+	sealedKeyLength  = 32 + 32 + 16
+	maxTopicKeyBatch = 1000
+)
+
+//Encryption of a message on a private topic. The broker only checks and forwards it: Title, Message, Body and the content
+//type travel inside the ciphertext, while Headers stay readable on purpose so that subscription filters can match them
+type Encryption struct {
+	Algorithm  string `json:"Algorithm"`
+	KeyVersion int    `json:"KeyVersion"` //version of the topic key the message is encrypted with
+}
+
+//Public key of a user, topic keys are sealed to it
+type PublicKey struct {
+	Email     string `json:"Email"`
+	PublicKey []byte `json:"PublicKey"` //X25519, base64 in JSON
+}
+
+//Topic key of a version sealed to the public key of every member, by member email
+type TopicKeys struct {
+	Topic   string            `json:"Topic"`
+	Version int               `json:"Version"`
+	Keys    map[string][]byte `json:"Keys"`
+}
+
+//Topic key of a version sealed to the public key of the session user
+type TopicKey struct {
+	Topic   string `json:"Topic"`
+	Version int    `json:"Version"`
+	Key     []byte `json:"Key"`
+}
+
+//Checking if user can publish, subscribe and read keys of topic: everybody on public topics, members on private ones
+func (eb *EventBroker) canAccess(topic string, email string) bool {
+
+	eb.rm.RLock()
+	definition := eb.definitions[topic]
+	eb.rm.RUnlock()
+
+	return !definition.Private || stringInSlice(email, definition.Members)
+}
+
+func (eb *EventBroker) isPrivate(topic string) bool {
+
+	eb.rm.RLock()
+	defer eb.rm.RUnlock()
+
+	return eb.definitions[topic].Private
+}
+
+//Keeping topics user can access
+func (eb *EventBroker) accessibleTopics(topics Topics, email string) Topics {
+
+	var accessible Topics
+
+	for _, topic := range topics {
+
+		if eb.canAccess(topic, email) {
+			accessible = append(accessible, topic)
+		}
+	}
+
+	return accessible
+}
+
+//Checking that messages of private topics are encrypted and carry no plaintext, and that the others are not
+func (eb *EventBroker) validateEncryption(message MessageData) error {
+
+	if !eb.isPrivate(message.Topic) {
+
+		if message.Encryption != nil {
+			return errors.New("encryption is only allowed on private topics")
+		}
+
+		return nil
+	}
+
+	if message.Encryption == nil || message.Encryption.Algorithm != encryptionAlgorithm {
+		return fmt.Errorf("messages of private topics must be encrypted with %s", encryptionAlgorithm)
+	}
+
+	if message.Encryption.KeyVersion <= 0 {
+		return errors.New("key version must be positive")
+	}
+
+	if message.Title != "" || message.Message != "" || len(message.Body) > 0 || len(message.Attachments) > 0 {
+		return errors.New("messages of private topics carry only the ciphertext in Data")
+	}
+
+	if message.ContentType != "" {
+		return errors.New("content type of messages of private topics must be encrypted with the payload")
+	}
+
+	if len(message.Data) == 0 {
+		return errors.New("expected ciphertext in Data")
+	}
+
+	return nil
+}
+
+var errUnknownKeyVersion = errors.New("key version not stored")
+
+//Checking that an encrypted message uses a key version stored for its topic, otherwise no member could decrypt it.
+//Errors other than errUnknownKeyVersion come from db
+func (r *Receivers) checkKeyVersion(ctx context.Context, message MessageData) error {
+
+	if message.Encryption == nil {
+		return nil
+	}
+
+	var latest int
+
+	err := r.dbServer.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM topic_keys WHERE topic = $1`,
+		message.Topic).Scan(&latest)
+
+	if err != nil {
+
+		dbErrors.WithLabelValues("select-topic-key").Inc()
+		return err
+	}
+
+	if message.Encryption.KeyVersion > latest {
+		return fmt.Errorf("%w: key version %d of %s, latest is %d", errUnknownKeyVersion, message.Encryption.KeyVersion,
+			message.Topic, latest)
+	}
+
+	return nil
+}
+
+//Registering public key of the session user, replacing the previous one
+func (r *Receivers) registerPublicKey(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var key PublicKey
+	err = json.NewDecoder(c.Request.Body).Decode(&key)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(key.PublicKey) != publicKeyLength {
+
+		c.JSON(http.StatusBadRequest, "Expected a "+strconv.Itoa(publicKeyLength)+" bytes X25519 public key")
+		return
+	}
+
+	_, err = r.dbServer.db.Exec(`INSERT INTO user_keys (email, public_key) VALUES ($1, $2) ON CONFLICT (email) DO UPDATE SET
+		public_key = EXCLUDED.public_key`, email, key.PublicKey)
+
+	if err != nil {
+		dbErrors.WithLabelValues("save-public-key").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	loggerFrom(c.Request.Context()).Info("public key registered")
+	key.Email = email
+	c.JSON(http.StatusOK, key)
+}
+
+//Getting public keys of the members of a private topic, so that a member can seal the topic key to them
+func (r *Receivers) publicKeys(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	topic := c.Query("topic")
+
+	if !r.eb.isPrivate(topic) || !r.eb.canAccess(topic, email) {
+
+		c.JSON(http.StatusForbidden, "Not a member of private topic "+topic)
+		return
+	}
+
+	r.eb.rm.RLock()
+	members := append([]string(nil), r.eb.definitions[topic].Members...)
+	r.eb.rm.RUnlock()
+
+	rows, err := r.dbServer.db.Query(`SELECT email, public_key FROM user_keys WHERE email = ANY($1) ORDER BY email`,
+		pq.Array(members))
+
+	if err != nil {
+		dbErrors.WithLabelValues("select-public-keys").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	defer rows.Close()
+
+	keys := []PublicKey{}
+
+	for rows.Next() {
+
+		var key PublicKey
+
+		if err = rows.Scan(&key.Email, &key.PublicKey); err != nil {
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+//Storing a topic key sealed to members by a member: a new version rotates the key, the current version can be sealed to
+//members that have no copy yet. The broker never sees the key itself
+func (r *Receivers) saveTopicKeys(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var keys TopicKeys
+	err = json.NewDecoder(c.Request.Body).Decode(&keys)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	logger := withLogFields(c, "topic", keys.Topic)
+
+	if !r.eb.isPrivate(keys.Topic) || !r.eb.canAccess(keys.Topic, email) {
+
+		c.JSON(http.StatusForbidden, "Not a member of private topic "+keys.Topic)
+		return
+	}
+
+	if len(keys.Keys) == 0 || len(keys.Keys) > maxTopicKeyBatch {
+
+		c.JSON(http.StatusBadRequest, "Expected between 1 and "+strconv.Itoa(maxTopicKeyBatch)+" sealed keys")
+		return
+	}
+
+	for member, key := range keys.Keys {
+
+		if !r.eb.canAccess(keys.Topic, member) {
+
+			c.JSON(http.StatusBadRequest, member+" is not a member of "+keys.Topic)
+			return
+		}
+
+		if len(key) != sealedKeyLength {
+
+			c.JSON(http.StatusBadRequest, "Sealed key of "+member+" must be "+strconv.Itoa(sealedKeyLength)+" bytes")
+			return
+		}
+	}
+
+	tx, err := r.dbServer.db.BeginTx(c.Request.Context(), nil)
+
+	if err != nil {
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	defer tx.Rollback()
+
+	var current int
+
+	//the topic row is locked, so that concurrent rotations get different versions
+	_, err = tx.Exec(`SELECT name FROM topics WHERE name = $1 FOR UPDATE`, keys.Topic)
+
+	if err == nil {
+		err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM topic_keys WHERE topic = $1`, keys.Topic).Scan(&current)
+	}
+
+	if err != nil {
+		dbErrors.WithLabelValues("save-topic-keys").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if keys.Version < 1 || (keys.Version != current && keys.Version != current+1) {
+
+		c.JSON(http.StatusConflict, "Expected version "+strconv.Itoa(current)+" or "+strconv.Itoa(current+1))
+		return
+	}
+
+	for member, key := range keys.Keys {
+
+		//copies already stored are kept, so that a member cannot replace the key of another one
+		_, err = tx.Exec(`INSERT INTO topic_keys (topic, version, member, sealed_key, created_by) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, keys.Topic, keys.Version, member, key, email)
+
+		if err != nil {
+			dbErrors.WithLabelValues("save-topic-keys").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		dbErrors.WithLabelValues("save-topic-keys").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger.Info("topic keys saved", "version", keys.Version, "members", len(keys.Keys))
+	c.JSON(http.StatusOK, TopicKeys{Topic: keys.Topic, Version: keys.Version})
+}
+
+//Getting topic key sealed to the session user, latest version unless version is given
+func (r *Receivers) topicKey(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	topic := c.Query("topic")
+
+	if !r.eb.isPrivate(topic) || !r.eb.canAccess(topic, email) {
+
+		c.JSON(http.StatusForbidden, "Not a member of private topic "+topic)
+		return
+	}
+
+	version, err := strconv.Atoi(c.DefaultQuery("version", "0"))
+
+	if err != nil || version < 0 {
+
+		c.JSON(http.StatusBadRequest, "Invalid version")
+		return
+	}
+
+	key := TopicKey{Topic: topic}
+
+	err = r.dbServer.db.QueryRow(`SELECT version, sealed_key FROM topic_keys WHERE topic = $1 AND member = $2 AND
+		($3 = 0 OR version = $3) ORDER BY version DESC LIMIT 1`, topic, email, version).Scan(&key.Version, &key.Key)
+
+	if errors.Is(err, sql.ErrNoRows) {
+
+		c.JSON(http.StatusNotFound, "No key of "+topic+" sealed to "+email)
+		return
+	}
+
+	if err != nil {
+		dbErrors.WithLabelValues("select-topic-key").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, key)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"github.com/twinj/uuid"
+	"log/slog"
+	"time"
+)
+
+//Instances sharing Redis publish accepted messages on redis-fanout-channel and merge the ones published by the others,
+//without topic owners: every instance assigns offsets, persists and filters duplicate requests on its own
+type fanout struct {
+	r        *Receivers
+	instance string
+	channel  string
+}
+
+type FanoutMessage struct {
+	Instance string      `json:"Instance"`
+	Message  MessageData `json:"Message"`
+}
+
+//Subscribing to the fan-out channel and sending accepted messages on it
+func (r *Receivers) initFanout() {
+
+	if !config().RedisFanoutEnabled {
+		return
+	}
+
+	f := &fanout{
+		r:        r,
+		instance: uuid.NewV4().String(),
+		channel:  config().RedisFanoutChannel,
+	}
+
+	subscription := client.Subscribe(ctx, f.channel)
+
+	//waiting for subscription confirmation, so that no message published after start-up is missed
+	if _, err := subscription.Receive(ctx); err != nil {
+		fatal("Redis fan-out channel not subscribed", err, "channel", f.channel)
+	}
+
+	r.eb.addListener(f.send)
+
+	if backgroundWorkers.start() {
+		go f.receive(subscription)
+	}
+
+	slog.Info("Redis fan-out started", "channel", f.channel, "instance", f.instance)
+}
+
+//Publishing accepted message to the other instances
+func (f *fanout) send(message MessageData) {
+
+	payload, err := json.Marshal(FanoutMessage{Instance: f.instance, Message: message})
+
+	if err == nil {
+		err = client.Publish(ctx, f.channel, payload).Err()
+	}
+
+	if err != nil {
+
+		fanoutMessages.WithLabelValues("failed").Inc()
+		slog.Warn("message not sent to other instances", "topic", message.Topic, "message_id", message.ID, "error", err)
+		return
+	}
+
+	fanoutMessages.WithLabelValues("sent").Inc()
+}
+
+//Merging messages of other instances until shutdown, the Redis client subscribes again after connection errors
+func (f *fanout) receive(subscription *redis.PubSub) {
+
+	defer backgroundWorkers.done()
+	defer subscription.Close()
+
+	messages := subscription.Channel()
+
+	for {
+
+		select {
+
+		case <-shutdownSignal:
+			return
+
+		case received, ok := <-messages:
+
+			if !ok {
+				return
+			}
+
+			f.merge(received.Payload)
+		}
+	}
+}
+
+func (f *fanout) merge(payload string) {
+
+	var received FanoutMessage
+
+	if err := json.Unmarshal([]byte(payload), &received); err != nil {
+
+		fanoutMessages.WithLabelValues("invalid").Inc()
+		slog.Warn("invalid message on fan-out channel", "channel", f.channel, "error", err)
+		return
+	}
+
+	//messages of this instance come back too
+	if received.Instance == f.instance {
+		return
+	}
+
+	result := f.r.mergeRemote(&received.Message)
+	fanoutMessages.WithLabelValues(result).Inc()
+
+	if result == "merged" && f.r.mqtt != nil {
+		f.r.mqtt.dispatch(received.Message)
+	}
+}
+
+//Inserting a message published on another instance with the next local offset, since offsets are assigned by every
+//instance on its own. Limits of the topic apply as on publishTo. Returns merged, duplicate or rejected
+func (r *Receivers) mergeRemote(message *MessageData) string {
+
+	limits := r.eb.limits(message.Topic)
+	q := r.eb.queue(message.Topic)
+
+	q.rm.RLock()
+	defer q.rm.RUnlock()
+
+	p := q.partitionOf(message)
+
+	//duplicates are filtered before making room, so that they do not drop messages. The channel is read by a single
+	//goroutine, no other one logs the message before the partition is locked again
+	p.rm.RLock()
+	duplicate := p.logged(message.ID)
+	p.rm.RUnlock()
+
+	if duplicate {
+		return "duplicate"
+	}
+
+	limits.capLifetime(message)
+	active := time.Now().Local().Before(message.ExpirationTime)
+
+	var dropped MessageDataSlice
+	var reason string
+
+	//expired messages are only kept for replay, they take no room
+	if active {
+		dropped, reason = q.makeRoom(*message, limits)
+	}
+
+	p.rm.Lock()
+
+	if reason == "" {
+
+		message.Offset = q.offset.Add(1)
+		p.log = append(p.log, *message)
+
+		if active {
+			p.enqueue(*message)
+		}
+	}
+
+	p.rm.Unlock()
+
+	if reason != "" || len(dropped) > 0 {
+
+		topicOverflows.WithLabelValues(message.Topic, limits.policy).Inc()
+		r.releaseDropped(dropped)
+	}
+
+	if reason != "" {
+		return "rejected"
+	}
+
+	return "merged"
+}
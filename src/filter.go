@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//Longest filter expression accepted on subscribe
+const maxFilterLength = 1024
+
+//Filter of a subscription over message fields and headers, e.g. price < 500 AND category = "usato". Identifiers name a
+//message field (title, topic, content_type, message, radius, lifetime, latitude, longitude, partition_key), else a header,
+//else a field of the JSON Body, with dots for nested fields. Comparisons on missing attributes are false
+type subscriptionFilter struct {
+	expression string
+	root       filterNode
+}
+
+//Filters of the subscriptions of a user, key: topic
+type topicFilters map[string]*subscriptionFilter
+
+type filterNode interface {
+	match(m *filterMessage) bool
+}
+
+//Message being matched, its Body is decoded once for all comparisons
+type filterMessage struct {
+	message *MessageData
+	body    map[string]interface{}
+	decoded bool
+}
+
+type filterAnd struct{ left, right filterNode }
+
+type filterOr struct{ left, right filterNode }
+
+type filterNot struct{ operand filterNode }
+
+type filterComparison struct {
+	attribute string
+	operator  string
+	value     interface{} //string, float64 or bool
+}
+
+//Message fields filters can refer to, by lower case name
+var filterFields = map[string]func(message *MessageData) interface{}{
+	"title":         func(message *MessageData) interface{} { return message.Title },
+	"topic":         func(message *MessageData) interface{} { return message.Topic },
+	"content_type":  func(message *MessageData) interface{} { return message.ContentType },
+	"message":       func(message *MessageData) interface{} { return message.Message },
+	"radius":        func(message *MessageData) interface{} { return float64(message.Radius) },
+	"lifetime":      func(message *MessageData) interface{} { return float64(message.LifeTime) },
+	"latitude":      func(message *MessageData) interface{} { return message.Latitude },
+	"longitude":     func(message *MessageData) interface{} { return message.Longitude },
+	"partition_key": func(message *MessageData) interface{} { return message.PartitionKey },
+}
+
+//Setting filter of a subscription, an empty expression removes it. Expressions are checked on subscribe, one failing here
+//comes from a newer version and is ignored
+func (eb *EventBroker) setFilter(subscriber string, topic string, expression string) {
+
+	filter, err := compileFilter(expression)
+
+	if err != nil {
+		slog.Error("subscription filter ignored", "subscriber", subscriber, "topic", topic, "error", err)
+	}
+
+	eb.rm.Lock()
+	defer eb.rm.Unlock()
+
+	if filter == nil {
+
+		delete(eb.filters[subscriber], topic)
+		return
+	}
+
+	if eb.filters[subscriber] == nil {
+		eb.filters[subscriber] = topicFilters{}
+	}
+
+	eb.filters[subscriber][topic] = filter
+}
+
+//Replacing filters of subscriber, key: topic - value: expression
+func (eb *EventBroker) replaceFilters(subscriber string, expressions map[string]string) {
+
+	eb.rm.Lock()
+	delete(eb.filters, subscriber)
+	eb.rm.Unlock()
+
+	for topic, expression := range expressions {
+		eb.setFilter(subscriber, topic, expression)
+	}
+}
+
+//Getting filter expression of a subscription, empty if it has none
+func (eb *EventBroker) filterExpression(subscriber string, topic string) string {
+
+	if filter := eb.userFilters(subscriber)[topic]; filter != nil {
+		return filter.expression
+	}
+
+	return ""
+}
+
+//Getting a copy of filters of subscriber by topic, topics without filter are missing
+func (eb *EventBroker) userFilters(subscriber string) topicFilters {
+
+	eb.rm.RLock()
+	defer eb.rm.RUnlock()
+
+	filters := topicFilters{}
+
+	for topic, filter := range eb.filters[subscriber] {
+		filters[topic] = filter
+	}
+
+	return filters
+}
+
+//Keeping messages passing the filter of the subscription to their topic
+func applyFilters(messages []MessageData, filters topicFilters) []MessageData {
+
+	if len(filters) == 0 {
+		return messages
+	}
+
+	var matching []MessageData
+
+	for _, message := range messages {
+
+		if filters[message.Topic].matches(message) {
+			matching = append(matching, message)
+		}
+	}
+
+	return matching
+}
+
+//Compiling filter expression, an empty expression gives a nil filter matching every message
+func compileFilter(expression string) (*subscriptionFilter, error) {
+
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+
+	if len(expression) > maxFilterLength {
+		return nil, fmt.Errorf("filter longer than %d characters", maxFilterLength)
+	}
+
+	var root filterNode
+	tokens, err := lexFilter(expression)
+
+	if err == nil {
+
+		p := &filterParser{tokens: tokens}
+		root, err = p.parseOr()
+
+		if err == nil && p.position < len(p.tokens) {
+			err = fmt.Errorf("unexpected %q", p.tokens[p.position].text)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("filter not valid: %w", err)
+	}
+
+	return &subscriptionFilter{expression: expression, root: root}, nil
+}
+
+//Checking if message passes filter, a nil filter passes every message
+func (f *subscriptionFilter) matches(message MessageData) bool {
+
+	if f == nil {
+		return true
+	}
+
+	return f.root.match(&filterMessage{message: &message})
+}
+
+func (n filterAnd) match(m *filterMessage) bool { return n.left.match(m) && n.right.match(m) }
+
+func (n filterOr) match(m *filterMessage) bool { return n.left.match(m) || n.right.match(m) }
+
+func (n filterNot) match(m *filterMessage) bool { return !n.operand.match(m) }
+
+func (n filterComparison) match(m *filterMessage) bool {
+
+	value, found := m.attribute(n.attribute)
+
+	if !found {
+		return false
+	}
+
+	var comparison int
+
+	switch literal := n.value.(type) {
+
+	case float64:
+
+		number, ok := filterNumber(value)
+
+		if !ok {
+			return false
+		}
+
+		comparison = compareNumbers(number, literal)
+
+	case string:
+		comparison = strings.Compare(filterText(value), literal)
+
+	case bool:
+
+		if filterText(value) != strconv.FormatBool(literal) {
+			comparison = 1
+		}
+	}
+
+	switch n.operator {
+
+	case "=":
+		return comparison == 0
+
+	case "!=":
+		return comparison != 0
+
+	case "<":
+		return comparison < 0
+
+	case "<=":
+		return comparison <= 0
+
+	case ">":
+		return comparison > 0
+
+	default:
+		return comparison >= 0
+	}
+}
+
+//Getting value of a message field, header or Body field
+func (m *filterMessage) attribute(name string) (interface{}, bool) {
+
+	if field, found := filterFields[strings.ToLower(name)]; found {
+		return field(m.message), true
+	}
+
+	if value, found := m.message.Headers[name]; found {
+		return value, true
+	}
+
+	if !m.decoded {
+
+		m.decoded = true
+		decoder := json.NewDecoder(bytes.NewReader(m.message.Body))
+		decoder.UseNumber()
+		_ = decoder.Decode(&m.body)
+	}
+
+	var value interface{} = m.body
+
+	for _, key := range strings.Split(name, ".") {
+
+		object, ok := value.(map[string]interface{})
+
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+func filterNumber(value interface{}) (float64, bool) {
+
+	switch v := value.(type) {
+
+	case float64:
+		return v, true
+
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+
+	return 0, false
+}
+
+func filterText(value interface{}) string {
+
+	switch v := value.(type) {
+
+	case string:
+		return v
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case nil:
+		return "null"
+	}
+
+	//json.Number, bool, objects and arrays of the Body
+	encoded, _ := json.Marshal(value)
+
+	return string(encoded)
+}
+
+func compareNumbers(a float64, b float64) int {
+
+	switch {
+
+	case a < b:
+		return -1
+
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+type filterTokenKind int
+
+const (
+	tokenIdentifier filterTokenKind = iota
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenOpen
+	tokenClose
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+//Splitting expression into identifiers, quoted strings, numbers, comparison operators and parentheses
+func lexFilter(expression string) ([]filterToken, error) {
+
+	var tokens []filterToken
+	runes := []rune(expression)
+
+	identifierRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+	}
+
+	for i := 0; i < len(runes); {
+
+		r := runes[i]
+
+		switch {
+
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+
+			kind := tokenOpen
+
+			if r == ')' {
+				kind = tokenClose
+			}
+
+			tokens = append(tokens, filterToken{kind, string(r)})
+			i++
+
+		case r == '"' || r == '\'':
+
+			var text strings.Builder
+			i++
+
+			for i < len(runes) && runes[i] != r {
+
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+
+				text.WriteRune(runes[i])
+				i++
+			}
+
+			if i == len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+
+			tokens = append(tokens, filterToken{tokenString, text.String()})
+			i++
+
+		case strings.ContainsRune("=!<>", r):
+
+			operator := string(r)
+
+			if i+1 < len(runes) && stringInSlice(string(runes[i:i+2]), []string{"==", "!=", "<>", "<=", ">="}) {
+				operator = string(runes[i : i+2])
+			}
+
+			if operator == "!" {
+				return nil, errors.New("expected != after !")
+			}
+
+			i += len(operator)
+
+			//== and <> are accepted as = and !=
+			switch operator {
+
+			case "==":
+				operator = "="
+
+			case "<>":
+				operator = "!="
+			}
+
+			tokens = append(tokens, filterToken{tokenOperator, operator})
+
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+
+			start := i
+			i++
+
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune(".eE+-", runes[i])) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{tokenNumber, string(runes[start:i])})
+
+		case unicode.IsLetter(r) || r == '_':
+
+			start := i
+
+			for i < len(runes) && identifierRune(runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, filterToken{tokenIdentifier, string(runes[start:i])})
+
+		default:
+			return nil, fmt.Errorf("unexpected %q", r)
+		}
+	}
+
+	return tokens, nil
+}
+
+//Recursive descent parser: OR binds weaker than AND, AND weaker than NOT
+type filterParser struct {
+	tokens   []filterToken
+	position int
+}
+
+func (p *filterParser) keyword(word string) bool {
+
+	if p.position < len(p.tokens) && p.tokens[p.position].kind == tokenIdentifier &&
+		strings.EqualFold(p.tokens[p.position].text, word) {
+
+		p.position++
+		return true
+	}
+
+	return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+
+	if p.position == len(p.tokens) {
+		return filterToken{}, errors.New("unexpected end of filter")
+	}
+
+	p.position++
+
+	return p.tokens[p.position-1], nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+
+	left, err := p.parseAnd()
+
+	for err == nil && p.keyword("OR") {
+
+		var right filterNode
+		right, err = p.parseAnd()
+		left = filterOr{left, right}
+	}
+
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+
+	left, err := p.parseNot()
+
+	for err == nil && p.keyword("AND") {
+
+		var right filterNode
+		right, err = p.parseNot()
+		left = filterAnd{left, right}
+	}
+
+	return left, err
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+
+	if p.keyword("NOT") {
+
+		operand, err := p.parseNot()
+		return filterNot{operand}, err
+	}
+
+	token, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token.kind == tokenOpen {
+
+		node, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if closing, err := p.next(); err != nil || closing.kind != tokenClose {
+			return nil, errors.New("expected )")
+		}
+
+		return node, nil
+	}
+
+	if token.kind != tokenIdentifier {
+		return nil, fmt.Errorf("expected attribute name, found %q", token.text)
+	}
+
+	return p.parseComparison(token.text)
+}
+
+func (p *filterParser) parseComparison(attribute string) (filterNode, error) {
+
+	operator, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if operator.kind != tokenOperator {
+		return nil, fmt.Errorf("expected comparison operator after %s, found %q", attribute, operator.text)
+	}
+
+	literal, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := filterComparison{attribute: attribute, operator: operator.text}
+
+	switch {
+
+	case literal.kind == tokenString:
+		comparison.value = literal.text
+
+	case literal.kind == tokenNumber:
+
+		number, err := strconv.ParseFloat(literal.text, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", literal.text)
+		}
+
+		comparison.value = number
+
+	case literal.kind == tokenIdentifier && (strings.EqualFold(literal.text, "true") || strings.EqualFold(literal.text, "false")):
+
+		if operator.text != "=" && operator.text != "!=" {
+			return nil, fmt.Errorf("%s compares booleans, only = and != are allowed", attribute)
+		}
+
+		comparison.value = strings.EqualFold(literal.text, "true")
+
+	default:
+		return nil, fmt.Errorf("expected string, number or boolean after %s %s, found %q", attribute, operator.text, literal.text)
+	}
+
+	return comparison, nil
+}
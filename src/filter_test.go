@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+//Message matched by the filters of TestFilterMatch: headers are looked up before the Body
+var filterFixture = MessageData{
+	Topic:    "Auto",
+	Title:    "Fiat Panda",
+	Radius:   10,
+	LifeTime: 60,
+	Headers:  map[string]string{"category": "usato", "price": "300", "urgent": "true"},
+	Body:     []byte(`{"price": 450, "seller": {"name": "Gino", "rating": 4.5}, "used": true, "note": null}`),
+}
+
+func TestFilterMatch(t *testing.T) {
+
+	tests := []struct {
+		expression string
+		match      bool
+	}{
+		//operators and quoting
+		{`category = "usato"`, true},
+		{`category = 'usato'`, true},
+		{`category == "usato"`, true},
+		{`category != "usato"`, false},
+		{`category <> "nuovo"`, true},
+		{`radius >= 10`, true},
+		{`radius > 10`, false},
+		{`radius <= 10`, true},
+		{`lifetime = 60`, true},
+
+		//message fields are case insensitive, headers and Body fields are not
+		{`TITLE = "Fiat Panda"`, true},
+		{`Category = "usato"`, false},
+
+		//AND binds stronger than OR, NOT stronger than AND
+		{`category = "usato" OR radius = 5 AND price < 100`, true},
+		{`(category = "usato" OR radius = 5) AND price < 100`, false},
+		{`NOT category = "usato" OR radius = 10`, true},
+		{`NOT (category = "usato" OR radius = 10)`, false},
+		{`category = "usato" and radius = 10`, true},
+		{`((radius = 10))`, true},
+
+		//the price header shadows the price of the Body
+		{`price < 400`, true},
+		{`price > 400`, false},
+
+		//Body fields, nested with dots
+		{`seller.name = "Gino"`, true},
+		{`seller.rating > 4`, true},
+		{`seller.rating = "4.5"`, true},
+		{`note = "null"`, true},
+
+		//comparisons on missing attributes are false, also !=
+		{`missing = 1`, false},
+		{`missing != 1`, false},
+		{`seller.missing = "Gino"`, false},
+		{`seller.name.first = "Gino"`, false},
+		{`NOT missing = 1`, true},
+
+		//numbers compare numerically, also with numeric strings, strings compare as text
+		{`price = 300.0`, true},
+		{`price = "300"`, true},
+		{`price = "300.0"`, false},
+		{`radius < 9.5e1`, true},
+		{`title > 5`, false},
+		{`title != 5`, false},
+		{`title > "Fiat"`, true},
+
+		//booleans of the Body and of headers
+		{`used = true`, true},
+		{`used != false`, true},
+		{`used = FALSE`, false},
+		{`urgent = true`, true},
+	}
+
+	for _, test := range tests {
+
+		t.Run(test.expression, func(t *testing.T) {
+
+			filter, err := compileFilter(test.expression)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if filter.expression != test.expression {
+				t.Fatalf("expression not kept: %q", filter.expression)
+			}
+
+			if match := filter.matches(filterFixture); match != test.match {
+				t.Fatalf("expected match %v, got %v", test.match, match)
+			}
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{"missing literal", `price <`},
+		{"missing operator", `price 500`},
+		{"missing attribute", `= 500`},
+		{"unclosed parenthesis", `(price < 500`},
+		{"unopened parenthesis", `price < 500)`},
+		{"empty parentheses", `()`},
+		{"dangling AND", `price < 500 AND`},
+		{"dangling NOT", `NOT`},
+		{"bang alone", `price ! 5`},
+		{"unterminated string", `title = "open`},
+		{"invalid number", `price < 1-2`},
+		{"identifier as literal", `price < abc`},
+		{"ordered boolean", `used < true`},
+		{"unexpected character", `price < 500 & radius > 1`},
+		{"two comparisons", `price < 500 radius > 1`},
+		{"too long", `title = "` + strings.Repeat("a", maxFilterLength) + `"`},
+	}
+
+	for _, test := range tests {
+
+		t.Run(test.name, func(t *testing.T) {
+
+			if filter, err := compileFilter(test.expression); err == nil {
+				t.Fatalf("%q compiled to %+v", test.expression, filter.root)
+			}
+		})
+	}
+}
+
+func TestFilterEmpty(t *testing.T) {
+
+	for _, expression := range []string{"", "  \t"} {
+
+		filter, err := compileFilter(expression)
+
+		if err != nil || filter != nil {
+			t.Fatalf("expected no filter for %q, got %+v, %v", expression, filter, err)
+		}
+
+		//a nil filter passes every message
+		if !filter.matches(filterFixture) {
+			t.Fatal("message filtered by empty filter")
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+
+	filter, err := compileFilter(`radius > 5`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []MessageData{
+		{ID: "near", Topic: "Auto", Radius: 1},
+		{ID: "far", Topic: "Auto", Radius: 50},
+		{ID: "unfiltered", Topic: "Sport", Radius: 1},
+	}
+
+	matching := applyFilters(messages, topicFilters{"Auto": filter})
+
+	if len(matching) != 2 || matching[0].ID != "far" || matching[1].ID != "unfiltered" {
+		t.Fatalf("expected far and unfiltered, got %+v", matching)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+//Columns read by scanMessage
+const messageColumns = `message_id, payload, topic, radius, latitude, longitude, lifetime, title,
+	COALESCE(topic_offset, 0), COALESCE(insertion_time, lifetime), COALESCE(partition_key, ''), COALESCE(content_type, ''),
+	headers, body, data, attachments, encryption`
+
+//Messages within (message radius + subscriber radius) km from the subscriber, as checkDistance does
+const withinDistance = `ST_DWithin(position, ST_SetSRID(ST_MakePoint($%d, $%d), 4326)::geography, (radius + $%d) * 1000.0)`
+
+//Reading a row of messageColumns, messages persisted before message ids were introduced get a new one
+func scanMessage(rows *sql.Rows) (MessageData, error) {
+
+	var messageID, payload, topic, title sql.NullString
+	var partitionKey, contentType string
+	var radius sql.NullInt64
+	var latitude, longitude sql.NullFloat64
+	var offset int64
+	var lifetime, insertionTime time.Time
+	var headers, body, data, attachments, encryption []byte
+
+	err := rows.Scan(&messageID, &payload, &topic, &radius, &latitude, &longitude, &lifetime, &title, &offset, &insertionTime, &partitionKey,
+		&contentType, &headers, &body, &data, &attachments, &encryption)
+
+	if !messageID.Valid {
+		messageID.String = uuid.NewV4().String()
+	}
+
+	var messageHeaders map[string]string
+
+	if err == nil && len(headers) > 0 {
+		err = json.Unmarshal(headers, &messageHeaders)
+	}
+
+	var messageAttachments []Attachment
+
+	if err == nil && len(attachments) > 0 {
+		err = json.Unmarshal(attachments, &messageAttachments)
+	}
+
+	var messageEncryption *Encryption
+
+	if err == nil && len(encryption) > 0 {
+		err = json.Unmarshal(encryption, &messageEncryption)
+	}
+
+	return MessageData{
+		ID:             messageID.String,
+		Message:        payload.String,
+		Title:          title.String,
+		Topic:          topic.String,
+		Radius:         int(radius.Int64),
+		Offset:         offset,
+		InsertionTime:  insertionTime,
+		ExpirationTime: lifetime,
+		Latitude:       latitude.Float64,
+		Longitude:      longitude.Float64,
+		PartitionKey:   partitionKey,
+		ContentType:    contentType,
+		Headers:        messageHeaders,
+		Body:           body,
+		Data:           data,
+		Attachments:    messageAttachments,
+		Encryption:     messageEncryption,
+	}, err
+}
+
+func scanMessages(rows *sql.Rows) (MessageDataSlice, error) {
+
+	defer rows.Close()
+
+	messages := MessageDataSlice{}
+
+	for rows.Next() {
+
+		message, err := scanMessage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+//Script of the migration creating the position column, its trigger and index
+const postgisMigration = "migrations/0007_postgis.up.sql"
+
+//Creating at start-up the objects of the PostGIS migration, which is skipped when the extension is not available
+func (s *server) setupPostGIS() {
+
+	err := withMigrationLock(s.db, func(conn *sql.Conn) error {
+
+		var available bool
+
+		err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis')`).
+			Scan(&available)
+
+		if err != nil {
+			return err
+		}
+
+		if !available {
+			return errors.New("postgis extension not available on the database server")
+		}
+
+		script, err := migrationFiles.ReadFile(postgisMigration)
+
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(string(script)); err != nil {
+
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	})
+
+	if err != nil {
+		fatal("postgis-enabled requires the PostGIS extension and the messages.position column", err)
+	}
+}
+
+//Matching active messages of topics within distance from the subscriber with the GiST index on position
+func (s *server) nearbyMessages(ctx context.Context, topics []string, subscriber MessageData) (MessageDataSlice, error) {
+
+	sqlCtx, span := startSQLSpan(ctx, "SELECT", "messages")
+
+	rows, err := s.db.QueryContext(sqlCtx, `SELECT `+messageColumns+` FROM messages
+		WHERE topic = ANY($1) AND lifetime > $2 AND `+fmt.Sprintf(withinDistance, 3, 4, 5)+`
+		ORDER BY topic, topic_offset`,
+		pq.Array(topics), time.Now().Local(), subscriber.Longitude, subscriber.Latitude, subscriber.Radius)
+
+	if err != nil {
+
+		endSpan(span, err)
+		return nil, err
+	}
+
+	messages, err := scanMessages(rows)
+	endSpan(span, err)
+
+	return messages, err
+}
+
+//Reading replay log of topic from db, filtered by distance when subscriber radius is given
+func (s *server) replayMessages(ctx context.Context, topic string, offset int64, from time.Time, limit int,
+	subscriber *MessageData) (MessageDataSlice, error) {
+
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE topic = $1 AND COALESCE(topic_offset, 0) >= $2
+		AND COALESCE(insertion_time, lifetime) >= $3`
+	args := []interface{}{topic, offset, from, limit}
+
+	if subscriber != nil {
+
+		query += ` AND ` + fmt.Sprintf(withinDistance, 5, 6, 7)
+		args = append(args, subscriber.Longitude, subscriber.Latitude, subscriber.Radius)
+	}
+
+	query += ` ORDER BY topic_offset NULLS FIRST, id LIMIT $4`
+
+	sqlCtx, span := startSQLSpan(ctx, "SELECT", "messages")
+
+	rows, err := s.db.QueryContext(sqlCtx, query, args...)
+
+	if err != nil {
+
+		endSpan(span, err)
+		return nil, err
+	}
+
+	messages, err := scanMessages(rows)
+	endSpan(span, err)
+
+	return messages, err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Status of components checked by health and readiness probes
+type healthStatus struct {
+	brokerLoaded bool
+	heartbeats   map[string]time.Time //key: garbage collector - value: last sweep
+	rm           sync.RWMutex
+}
+
+type HealthReport struct {
+	Status string            `json:"Status"`
+	Checks map[string]string `json:"Checks"`
+}
+
+var health = &healthStatus{heartbeats: map[string]time.Time{}}
+
+//Handler answering probes while the event broker loads, every route is served by router once it is set
+type startupHandler struct {
+	probes *gin.Engine
+	router atomic.Pointer[gin.Engine]
+}
+
+func (r *Receivers) newStartupHandler() *startupHandler {
+
+	probes := gin.New()
+	probes.GET("/healthz", healthz)
+	probes.GET("/readyz", r.readyz)
+	probes.NoRoute(func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, "Starting")
+	})
+
+	return &startupHandler{probes: probes}
+}
+
+func (h *startupHandler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+
+	if router := h.router.Load(); router != nil {
+
+		router.ServeHTTP(w, request)
+		return
+	}
+
+	h.probes.ServeHTTP(w, request)
+}
+
+//Recording a garbage collector sweep
+func (h *healthStatus) beat(collector string) {
+
+	h.rm.Lock()
+	h.heartbeats[collector] = time.Now()
+	h.rm.Unlock()
+}
+
+//Marking event broker as loaded by initEB
+func (h *healthStatus) setLoaded() {
+
+	h.rm.Lock()
+	h.brokerLoaded = true
+	h.rm.Unlock()
+}
+
+//Checking that garbage collectors swept within twice their period, they start once the event broker is loaded
+func (h *healthStatus) checkCollectors(checks map[string]string) bool {
+
+	periods := map[string]int{
+		"messages": config().GarbageCollectorPeriod,
+		"requests": config().EliminationPeriod,
+	}
+
+	ok := true
+
+	h.rm.RLock()
+
+	for collector, period := range periods {
+
+		last, found := h.heartbeats[collector]
+		limit := time.Minute*time.Duration(2*period) + time.Minute
+
+		if !found && !h.brokerLoaded {
+
+			checks["gc-"+collector] = "not started"
+
+		} else if !found || time.Since(last) > limit {
+
+			checks["gc-"+collector] = "not running"
+			ok = false
+
+		} else {
+
+			checks["gc-"+collector] = "ok"
+		}
+	}
+
+	h.rm.RUnlock()
+
+	return ok
+}
+
+//Retrying a start-up operation with exponential backoff
+func retryOnStartup(name string, operation func() error) error {
+
+	backoff := time.Millisecond * time.Duration(config().StartupRetryBackoff)
+	var err error
+
+	for attempt := 1; ; attempt++ {
+
+		err = operation()
+
+		if err == nil || attempt >= config().StartupRetryLimit {
+			break
+		}
+
+		slog.Warn("dependency not available", "dependency", name, "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return err
+}
+
+//Liveness probe, failing when garbage collectors are stuck
+func healthz(c *gin.Context) {
+
+	report := HealthReport{Status: "ok", Checks: map[string]string{}}
+
+	if !health.checkCollectors(report.Checks) {
+		report.Status = "fail"
+	}
+
+	writeHealthReport(c, report)
+}
+
+//Readiness probe, checking Postgres, Redis, event broker loading and garbage collectors
+func (r *Receivers) readyz(c *gin.Context) {
+
+	report := HealthReport{Status: "ok", Checks: map[string]string{}}
+
+	timeout, cancel := context.WithTimeout(c.Request.Context(), time.Second*2)
+	defer cancel()
+
+	if err := r.dbServer.db.PingContext(timeout); err != nil {
+
+		report.Checks["postgres"] = err.Error()
+		report.Status = "fail"
+
+	} else {
+
+		report.Checks["postgres"] = "ok"
+	}
+
+	if err := client.Ping(timeout).Err(); err != nil {
+
+		report.Checks["redis"] = err.Error()
+		report.Status = "fail"
+
+	} else {
+
+		report.Checks["redis"] = "ok"
+	}
+
+	health.rm.RLock()
+	loaded := health.brokerLoaded
+	health.rm.RUnlock()
+
+	if loaded {
+
+		report.Checks["broker"] = "ok"
+
+	} else {
+
+		report.Checks["broker"] = "loading"
+		report.Status = "fail"
+	}
+
+	if !health.checkCollectors(report.Checks) {
+		report.Status = "fail"
+	}
+
+	writeHealthReport(c, report)
+}
+
+func writeHealthReport(c *gin.Context, report HealthReport) {
+
+	code := http.StatusOK
+
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+
+	c.JSON(code, report)
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
 	"github.com/twinj/uuid"
-	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,20 +19,12 @@ type TokenDetails struct {
 	AtExpires   int64
 }
 
-var tokenExpirationTime = p.GetInt("token-expiration-time", 15)
-
 //Creating token for user session
 func CreateToken(email string) (*TokenDetails, error) {
 
 	td := &TokenDetails{}
-	td.AtExpires = time.Now().Local().Add(time.Minute * time.Duration(tokenExpirationTime)).Unix() //setting token expiration time
-	td.AccessUuid = uuid.NewV4().String()                                                          //setting token unique universal ID
-
-	err := os.Setenv("ACCESS_SECRET", "jdnfksdmfksd")
-
-	if err != nil {
-		log.Panic(err)
-	}
+	td.AtExpires = time.Now().Local().Add(time.Minute * time.Duration(config().TokenExpirationTime)).Unix() //setting token expiration time
+	td.AccessUuid = uuid.NewV4().String()                                                                   //setting token unique universal ID
 
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
@@ -40,7 +33,8 @@ func CreateToken(email string) (*TokenDetails, error) {
 	atClaims["exp"] = td.AtExpires
 
 	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	td.AccessToken, err = at.SignedString([]byte(os.Getenv("ACCESS_SECRET")))
+	var err error
+	td.AccessToken, err = at.SignedString([]byte(config().AccessSecret))
 
 	if err != nil {
 		return nil, err
@@ -49,13 +43,23 @@ func CreateToken(email string) (*TokenDetails, error) {
 	return td, nil
 }
 
+//Redis sorted set of session token uuids scored by their expiration (Unix ms), so that sessions are counted without
+//scanning the keyspace
+const sessionsKey = "sessions"
+
 //Inserting token into Redis db
-func CreateAuth(email string, td *TokenDetails) error {
+func CreateAuth(ctx context.Context, email string, td *TokenDetails) error {
 
 	at := time.Unix(td.AtExpires, 0) //converting Unix to UTC(to Time object)
 	now := time.Now().Local()
 
-	errAccess := client.Set(ctx, td.AccessUuid, email, at.Sub(now)).Err()
+	_, errAccess := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+
+		pipe.Set(ctx, td.AccessUuid, email, at.Sub(now))
+		pipe.ZAdd(ctx, sessionsKey, &redis.Z{Score: float64(at.UnixMilli()), Member: td.AccessUuid})
+
+		return nil
+	})
 
 	if errAccess != nil {
 
@@ -65,6 +69,18 @@ func CreateAuth(email string, td *TokenDetails) error {
 	return nil
 }
 
+//Counting sessions not expired yet, dropping the expired ones from the set
+func countSessions(ctx context.Context) (int64, error) {
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	if err := client.ZRemRangeByScore(ctx, sessionsKey, "-inf", now).Err(); err != nil {
+		return 0, err
+	}
+
+	return client.ZCard(ctx, sessionsKey).Result()
+}
+
 //Verifying token signature
 func VerifyToken(c *gin.Context) (*jwt.Token, error) {
 
@@ -78,7 +94,7 @@ func VerifyToken(c *gin.Context) (*jwt.Token, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(os.Getenv("ACCESS_SECRET")), nil
+		return []byte(config().AccessSecret), nil
 	})
 
 	if err != nil {
@@ -153,7 +169,7 @@ func ExtractTokenMetadata(c *gin.Context) (*AccessDetails, error) {
 }
 
 //Getting token from Redis db
-func FetchAuth(authD *AccessDetails) error {
+func FetchAuth(ctx context.Context, authD *AccessDetails) error {
 
 	_, err := client.Get(ctx, authD.AccessUuid).Result()
 
@@ -165,15 +181,23 @@ func FetchAuth(authD *AccessDetails) error {
 }
 
 //Deleting token from Redis db
-func DeleteAuth(givenUuid string) (int64, error) {
+func DeleteAuth(ctx context.Context, givenUuid string) (int64, error) {
 
-	deleted, err := client.Del(ctx, givenUuid).Result()
+	var deleted *redis.IntCmd
+
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+
+		deleted = pipe.Del(ctx, givenUuid)
+		pipe.ZRem(ctx, sessionsKey, givenUuid)
+
+		return nil
+	})
 
 	if err != nil {
 		return 0, err
 	}
 
-	return deleted, nil
+	return deleted.Val(), nil
 }
 
 //Checking user authorization for handler function
@@ -202,3 +226,20 @@ func TokenAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+//Checking that session user is an administrator, to be used after TokenAuthMiddleware
+func AdminMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		au, err := ExtractTokenMetadata(c)
+
+		if err != nil || au == nil || !stringInSlice(au.Email, config().adminUsers()) {
+
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"log/slog"
+	"time"
+)
+
+//Overflow policies applied when a topic reaches max-messages or max-bytes
+const (
+	overflowReject     = "reject"      //the publish is rejected
+	overflowDropOldest = "drop-oldest" //oldest active messages leave the queue and expire, they stay in replay log and db
+)
+
+//Limits of a topic with defaults applied, zero means unlimited
+type topicLimits struct {
+	maxLifetime int //minutes
+	maxMessages int64
+	maxBytes    int64
+	policy      string
+	maxRadius   int //km, checked on /publish
+}
+
+//Checking settings given by an administrator
+func (definition TopicDefinition) validate() error {
+
+	var errs []error
+
+	positive := func(value *int, message string) {
+
+		if value != nil && *value <= 0 {
+			errs = append(errs, errors.New(message))
+		}
+	}
+
+	if definition.Name == "" {
+		errs = append(errs, errors.New("expected topic name"))
+	}
+
+	if definition.Retention != nil && *definition.Retention < 0 {
+		errs = append(errs, errors.New("retention must not be negative"))
+	}
+
+	positive(definition.Partitions, "partitions must be positive")
+	positive(definition.MaxLifetime, "max lifetime must be positive")
+	positive(definition.MaxMessages, "max messages must be positive")
+	positive(definition.MaxRadius, "max radius must be positive")
+
+	if definition.MaxBytes != nil && *definition.MaxBytes <= 0 {
+		errs = append(errs, errors.New("max bytes must be positive"))
+	}
+
+	if definition.OverflowPolicy != nil && !validOverflowPolicy(*definition.OverflowPolicy) {
+		errs = append(errs, errors.New("overflow policy must be reject or drop-oldest"))
+	}
+
+	if len(definition.Schema) > 0 {
+
+		if _, err := compileSchema(definition.Schema); err != nil {
+			errs = append(errs, fmt.Errorf("schema not valid: %w", err))
+		}
+	}
+
+	if definition.Private {
+
+		if len(definition.Members) == 0 {
+			errs = append(errs, errors.New("private topics need members"))
+		}
+
+		//messages of private topics are encrypted, the broker cannot check them
+		if len(definition.Schema) > 0 {
+			errs = append(errs, errors.New("private topics cannot have a schema"))
+		}
+
+	} else if len(definition.Members) > 0 {
+		errs = append(errs, errors.New("only private topics have members"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validOverflowPolicy(policy string) bool {
+
+	return policy == overflowReject || policy == overflowDropOldest
+}
+
+//Getting limits of topic, topic-max-* settings apply when the topic does not set them
+func (eb *EventBroker) limits(topic string) topicLimits {
+
+	eb.rm.RLock()
+	definition := eb.definitions[topic]
+	eb.rm.RUnlock()
+
+	limits := topicLimits{
+		maxLifetime: config().TopicMaxLifetime,
+		maxMessages: int64(config().TopicMaxMessages),
+		maxBytes:    config().TopicMaxBytes,
+		policy:      config().TopicOverflowPolicy,
+		maxRadius:   config().TopicMaxRadius,
+	}
+
+	if definition.MaxLifetime != nil {
+		limits.maxLifetime = *definition.MaxLifetime
+	}
+
+	if definition.MaxMessages != nil {
+		limits.maxMessages = int64(*definition.MaxMessages)
+	}
+
+	if definition.MaxBytes != nil {
+		limits.maxBytes = *definition.MaxBytes
+	}
+
+	if definition.OverflowPolicy != nil {
+		limits.policy = *definition.OverflowPolicy
+	}
+
+	if definition.MaxRadius != nil {
+		limits.maxRadius = *definition.MaxRadius
+	}
+
+	return limits
+}
+
+//Marking messages as read, so that they are not dead-lettered as never read when they expire
+func (eb *EventBroker) markRead(ids []string) {
+
+	eb.rm.Lock()
+	defer eb.rm.Unlock()
+
+	for _, id := range ids {
+		eb.readMessages[id] = true
+	}
+}
+
+//Forgetting read state of messages dropped by the overflow policy, the garbage collector will not see them
+func (eb *EventBroker) forgetRead(messages MessageDataSlice) {
+
+	if len(messages) == 0 {
+		return
+	}
+
+	eb.rm.Lock()
+
+	for _, message := range messages {
+		delete(eb.readMessages, message.ID)
+	}
+
+	eb.rm.Unlock()
+}
+
+//Releasing messages dropped by drop-oldest: their rows are expired first, so that PostGIS and Postgres search stop returning
+//them, then their attachments are deleted. Attachments of rows not expired are left in the blob store
+func (r *Receivers) releaseDropped(dropped MessageDataSlice) {
+
+	if len(dropped) == 0 {
+		return
+	}
+
+	r.eb.forgetRead(dropped)
+
+	if config().DBPersistence {
+
+		ids := make([]string, len(dropped))
+
+		for i, message := range dropped {
+			ids[i] = message.ID
+		}
+
+		_, err := r.dbServer.db.Exec(`UPDATE messages SET lifetime = LEAST(lifetime, $2) WHERE message_id = ANY($1)`,
+			pq.Array(ids), time.Now().Local())
+
+		if err != nil {
+
+			dbErrors.WithLabelValues("expire-messages").Inc()
+			slog.Error("dropped messages not expired in db, their attachments are kept", "topic", dropped[0].Topic,
+				"messages", len(dropped), "error", err)
+			return
+		}
+	}
+
+	r.deleteAttachments(dropped...)
+}
+
+//Bytes of a message counted by max-bytes: payload, title, content type and headers
+func messageSize(message MessageData) int64 {
+
+	return int64(len(message.Message) + len(message.Title) + len(message.Body) + len(message.Data) + len(message.ContentType) +
+		headersSize(message.Headers))
+}
+
+//Lowering lifetime of message to max-lifetime, returns true if lowered
+func (limits topicLimits) capLifetime(message *MessageData) bool {
+
+	if limits.maxLifetime <= 0 || message.LifeTime <= limits.maxLifetime {
+		return false
+	}
+
+	message.LifeTime = limits.maxLifetime
+	message.ExpirationTime = message.InsertionTime.Add(time.Minute * time.Duration(limits.maxLifetime))
+
+	return true
+}
+
+//Reserving room in the topic for message according to the overflow policy, dropping the oldest active messages of the
+//topic if needed. Returns the dropped messages, or the reason why message is rejected. Caller holds q.rm but no partition lock
+func (q *topicQueue) makeRoom(message MessageData, limits topicLimits) (MessageDataSlice, string) {
+
+	size := messageSize(message)
+
+	if limits.maxBytes > 0 && size > limits.maxBytes {
+		return nil, "message larger than max-bytes of the topic"
+	}
+
+	var dropped MessageDataSlice
+
+	for {
+
+		reason := q.reserve(size, limits)
+
+		if reason == "" {
+			return dropped, ""
+		}
+
+		if limits.policy != overflowDropOldest {
+			return dropped, reason
+		}
+
+		oldest, found := q.dropOldest()
+
+		if !found {
+			return dropped, reason
+		}
+
+		dropped = append(dropped, oldest)
+	}
+}
+
+//Counting message of size in the topic totals if they stay within limits, so that publishers of different partitions
+//never exceed them together
+func (q *topicQueue) reserve(size int64, limits topicLimits) string {
+
+	for {
+
+		count := q.count.Load()
+
+		if limits.maxMessages > 0 && count >= limits.maxMessages {
+			return "max-messages of the topic reached"
+		}
+
+		if q.count.CompareAndSwap(count, count+1) {
+			break
+		}
+	}
+
+	for {
+
+		bytes := q.bytes.Load()
+
+		if limits.maxBytes > 0 && bytes+size > limits.maxBytes {
+
+			q.count.Add(-1)
+			return "max-bytes of the topic reached"
+		}
+
+		if q.bytes.CompareAndSwap(bytes, bytes+size) {
+			return ""
+		}
+	}
+}
+
+//Removing the active message of the topic with the lowest offset. Partitions are locked one at a time
+func (q *topicQueue) dropOldest() (MessageData, bool) {
+
+	for {
+
+		var oldest *partition
+		var offset int64
+
+		for _, p := range q.partitions {
+
+			p.rm.RLock()
+
+			//messages are ordered by offset, the oldest come first
+			if len(p.messages) > 0 && (oldest == nil || p.messages[0].Offset < offset) {
+				oldest, offset = p, p.messages[0].Offset
+			}
+
+			p.rm.RUnlock()
+		}
+
+		if oldest == nil {
+			return MessageData{}, false
+		}
+
+		oldest.rm.Lock()
+
+		//another publisher may have emptied the partition meanwhile
+		if len(oldest.messages) == 0 {
+
+			oldest.rm.Unlock()
+			continue
+		}
+
+		message := oldest.messages[0]
+		oldest.messages = oldest.messages[1:]
+		oldest.rm.Unlock()
+
+		q.account(-1, -messageSize(message))
+		q.index.remove(message)
+
+		return message, true
+	}
+}
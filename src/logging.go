@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/twinj/uuid"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type loggerKey struct{}
+
+//Writer shared by structured logger and gin recovery
+var logWriter io.Writer = os.Stderr
+
+//Changed by configuration reload
+var logLevel = new(slog.LevelVar)
+
+//Configuring default structured logger with level, format, sinks and file rotation
+func initLogging() {
+
+	var writers []io.Writer
+
+	for _, sink := range strings.Split(config().LogSinks, ",") {
+
+		switch strings.TrimSpace(sink) {
+
+		case "file":
+			writers = append(writers, &lumberjack.Logger{
+				Filename:   config().LogFile,
+				MaxSize:    config().LogMaxSize,
+				MaxBackups: config().LogMaxBackups,
+				MaxAge:     config().LogMaxAge,
+				Compress:   config().LogCompress,
+			})
+
+		case "stdout":
+			writers = append(writers, os.Stdout)
+
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		}
+	}
+
+	if len(writers) > 0 {
+		logWriter = io.MultiWriter(writers...)
+	}
+
+	setLogLevel(config().LogLevel)
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewJSONHandler(logWriter, options)
+
+	if config().LogFormat == "text" {
+		handler = slog.NewTextHandler(logWriter, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+func setLogLevel(name string) {
+
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	logLevel.Set(level)
+}
+
+//Logging error and terminating, used only during start-up
+func fatal(msg string, err error, args ...any) {
+
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
+}
+
+//Getting logger carrying request fields, the default logger outside of requests
+func loggerFrom(ctx context.Context) *slog.Logger {
+
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+//Adding fields to the logger of the request
+func withLogFields(c *gin.Context, args ...any) *slog.Logger {
+
+	logger := loggerFrom(c.Request.Context()).With(args...)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), loggerKey{}, logger))
+
+	return logger
+}
+
+//Assigning a request id (or keeping X-Request-ID sent by the client) and logging every request
+func RequestLoggerMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		requestID := c.GetHeader("X-Request-ID")
+
+		if requestID == "" {
+			requestID = uuid.NewV4().String()
+		}
+
+		c.Header("X-Request-ID", requestID)
+
+		args := []any{"request_id", requestID}
+
+		if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.IsValid() {
+			args = append(args, "trace_id", spanContext.TraceID().String())
+		}
+
+		withLogFields(c, args...)
+
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		loggerFrom(c.Request.Context()).Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP())
+	}
+}
+
+//Logging error with request fields and answering with given status code
+func failRequest(c *gin.Context, code int, err error) {
+
+	level := slog.LevelWarn
+
+	if code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	loggerFrom(c.Request.Context()).Log(c.Request.Context(), level, "request failed", "error", err)
+
+	c.AbortWithStatusJSON(code, http.StatusText(code))
+}
@@ -2,72 +2,139 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
-	"github.com/magiconair/properties"
-	"log"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/twinj/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Topic struct {
-	Name string
-	Flag bool
+	Name   string
+	Flag   bool
+	Filter string `json:",omitempty"`
+}
+
+//Body of subscription requests, Filter is an expression over message fields and headers (see subscriptionFilter)
+type SubscriptionRequest struct {
+	Topic  string `json:"Topic"`
+	Filter string `json:"Filter"`
+}
+
+//Settings of a topic, the matching setting of configuration applies when null
+type TopicDefinition struct {
+	Name           string          `json:"Name"`
+	Retention      *int            `json:"Retention"`         //minutes messages are kept for replay after expiration
+	Partitions     *int            `json:"Partitions"`        //number of partitions
+	MaxLifetime    *int            `json:"MaxLifetime"`       //minutes, longer lifetimes are lowered
+	MaxMessages    *int            `json:"MaxMessages"`       //active messages
+	MaxBytes       *int64          `json:"MaxBytes"`          //size of active messages
+	OverflowPolicy *string         `json:"OverflowPolicy"`    //reject or drop-oldest
+	MaxRadius      *int            `json:"MaxRadius"`         //km
+	Schema         json.RawMessage `json:"Schema,omitempty"`  //JSON Schema messages must conform to
+	Private        bool            `json:"Private,omitempty"` //only members publish and subscribe, messages are encrypted
+	Members        []string        `json:"Members,omitempty"` //emails of users allowed on a private topic
+}
+
+//Outcome of a publish: Result is "success", "fail" (the client may send the message again) or "rejected" (by a topic limit)
+type PublishResult struct {
+	Result         string `json:"Result"`
+	Reason         string `json:"Reason,omitempty"`
+	Offset         int64  `json:"Offset,omitempty"`
+	Partition      int    `json:"Partition"`
+	LifeTime       int    `json:"LifeTime"`
+	LifetimeCapped bool   `json:"LifetimeCapped,omitempty"` //LifeTime lowered to max lifetime of the topic
+	Dropped        int    `json:"Dropped,omitempty"`        //oldest messages dropped to make room
 }
 
 type MessageData struct {
-	Message        string    `json:"Message"`
-	Title          string    `json:"Title"`
-	Topic          string    `json:"Topic"`
-	RequestID      string    `json:"RequestID"`
-	Radius         int       `json:"Radius,string"`
-	LifeTime       int       `json:"LifeTime,string"`
-	InsertionTime  time.Time `json:"InsertionTime,string"`
-	ExpirationTime time.Time `json:"ExpirationTime,string"`
-	Latitude       float64   `json:"Latitude"`
-	Longitude      float64   `json:"Longitude"`
+	ID             string            `json:"ID"`
+	Message        string            `json:"Message"`
+	Title          string            `json:"Title"`
+	ContentType    string            `json:"ContentType,omitempty"` //media type of the payload
+	Headers        map[string]string `json:"Headers,omitempty"`     //producer key/value pairs, for routing without reading the payload
+	Body           json.RawMessage   `json:"Body,omitempty"`        //JSON payload
+	Data           []byte            `json:"Data,omitempty"`        //binary payload, base64 in JSON
+	Topic          string            `json:"Topic"`
+	RequestID      string            `json:"RequestID"`
+	Offset         int64             `json:"Offset"`
+	Radius         int               `json:"Radius,string"`
+	LifeTime       int               `json:"LifeTime,string"`
+	InsertionTime  time.Time         `json:"InsertionTime,string"`
+	ExpirationTime time.Time         `json:"ExpirationTime,string"`
+	Latitude       float64           `json:"Latitude"`
+	Longitude      float64           `json:"Longitude"`
+	TraceContext   map[string]string `json:"TraceContext,omitempty"` //W3C trace context of publish request
+	PartitionKey   string            `json:"PartitionKey,omitempty"` //geohash of position if empty
+	Partition      int               `json:"Partition"`
+	Attachments    []Attachment      `json:"Attachments,omitempty"` //files uploaded with a multipart publish
+	Encryption     *Encryption       `json:"Encryption,omitempty"`  //set on private topics, Data holds the ciphertext
 }
 
 type MessageDataSlice []MessageData
 
-type Topics []string
+//Published request of at-most-once and exactly-once semantics, only what is needed to suppress its duplicates
+type PublishedRequest struct {
+	RequestID     string    `json:"RequestID"`
+	Topic         string    `json:"Topic"`
+	Offset        int64     `json:"Offset"`
+	InsertionTime time.Time `json:"InsertionTime"` //requests are removed request-lifetime minutes after
+}
 
-var GlobalTopics Topics
+type Topics []string
 
 //Struct for queue implementation
 type EventBroker struct {
-	topicMessages map[string]MessageDataSlice //key: topic - value: messages
-	userTopics    map[string]Topics           //key: user  - value: topics
-	rm            sync.RWMutex
+	userTopics   map[string]Topics          //key: user  - value: topics
+	filters      map[string]topicFilters    //key: user  - value: subscription filters
+	listeners    []func(MessageData)        //functions called on every accepted message
+	readMessages map[string]bool            //key: id of messages returned by notifications
+	definitions  map[string]TopicDefinition //key: topic - value: settings
+	topics       Topics                     //topics messages can be published to
+	rm           sync.RWMutex
+
+	queues     map[string]*topicQueue //key: topic - value: partitioned messages
+	queuesLock sync.RWMutex
+
+	requests     map[string]PublishedRequest //key: request id - value: request, for requests filtering mechanism
+	requestsLock sync.Mutex
 }
 
 type Receivers struct {
 	dbServer server
-	eb       EventBroker
+	eb       *EventBroker
+	hooks    *webhookDispatcher
+	mqtt     *mqttServer
+	dlq      *deadLetterQueue
+	cluster  *cluster
+	raft     *raftNode
+	blobs    BlobStore
 }
 
-//Map for requests filtering mechanism
-var requests = make(map[string]MessageData)
+var router = gin.New()
 
-//Loading from properties file
-var p = properties.MustLoadFile("../conf.properties", properties.UTF8)
-var dbPersistence = p.GetBool("db-persistence", true)
-var deliverySemantic = p.GetString("delivery-semantic", "at-least-once")
-var retryLimit = p.GetInt("retry-limit", 5)
-var deliveryTimeout = p.GetInt("delivery-timeout", 100)
-var eliminationPeriod = p.GetInt("elimination-period", 1)
-var requestLifetime = p.GetInt("request-lifetime", 2)
-var garbageCollectorPeriod = p.GetInt("garbage-collector-period", 1)
-var listeningPort = p.GetString("app-listening-port", "8080")
+func newEventBroker() *EventBroker {
 
-var router = gin.Default()
-
-var logFile os.File
+	return &EventBroker{
+		userTopics:   map[string]Topics{},
+		filters:      map[string]topicFilters{},
+		readMessages: map[string]bool{},
+		definitions:  map[string]TopicDefinition{},
+		queues:       map[string]*topicQueue{},
+		requests:     map[string]PublishedRequest{},
+	}
+}
 
 //Adding user subscription into EventBroker
 func (r *Receivers) topicSubscription(topic string, email string) {
@@ -105,91 +172,348 @@ func (r *Receivers) topicUnsubscription(email string, topic string) {
 	}
 
 	delete(r.eb.userTopics, email)
+	delete(r.eb.filters[email], topic)
 
 	r.eb.userTopics[email] = newTopicList
 
 	r.eb.rm.Unlock()
 }
 
-//Inserting message into EventBroker
-func (r *Receivers) publishTo(messageData MessageData) bool {
+//Getting a copy of the topics user is subscribed to, subscriptions are also replaced by Raft restoring a snapshot
+func (eb *EventBroker) subscribedTopics(email string) Topics {
 
-	r.eb.rm.Lock()
+	eb.rm.RLock()
+	defer eb.rm.RUnlock()
+
+	return append(Topics(nil), eb.userTopics[email]...)
+}
+
+//Replacing subscriptions of user with the ones in db, changed by another node
+func (r *Receivers) reloadSubscriptions(email string) error {
+
+	rows, err := r.dbServer.db.Query(`SELECT topic, COALESCE(filter, '') FROM subscriptions WHERE subscriber = $1 ORDER BY topic`,
+		email)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var topics Topics
+	filters := map[string]string{}
+
+	for rows.Next() {
 
-	checked := false
+		var topic, filter string
 
-	size := len(r.eb.topicMessages[messageData.Topic])
-	r.eb.topicMessages[messageData.Topic] = append(r.eb.topicMessages[messageData.Topic], messageData)
-	sizeAfter := len(r.eb.topicMessages[messageData.Topic])
+		if err = rows.Scan(&topic, &filter); err != nil {
+			return err
+		}
+
+		topics = append(topics, topic)
+		filters[topic] = filter
+	}
 
-	//size is bigger if insertion is completed
-	if sizeAfter > size {
-		checked = true
+	if err = rows.Err(); err != nil {
+		return err
 	}
 
+	r.eb.rm.Lock()
+	r.eb.userTopics[email] = topics
 	r.eb.rm.Unlock()
 
-	return checked
+	r.eb.replaceFilters(email, filters)
+
+	return nil
+}
+
+//Registering a function called on every accepted message
+func (eb *EventBroker) addListener(listener func(MessageData)) {
+
+	eb.rm.Lock()
+	eb.listeners = append(eb.listeners, listener)
+	eb.rm.Unlock()
+}
+
+//Forwarding accepted message to registered listeners
+func (eb *EventBroker) notifyListeners(messageData MessageData) {
+
+	eb.rm.RLock()
+	listeners := eb.listeners
+	eb.rm.RUnlock()
+
+	for _, listener := range listeners {
+		listener(messageData)
+	}
+}
+
+//Inserting message into its partition, assigning its offset if not restored from db. Limits of the topic apply to new messages
+func (r *Receivers) publishTo(messageData *MessageData) PublishResult {
+
+	restored := messageData.Offset != 0
+	limits := r.eb.limits(messageData.Topic)
+	q := r.eb.queue(messageData.Topic)
+
+	q.rm.RLock()
+
+	result := PublishResult{Result: "success"}
+	var dropped MessageDataSlice
+
+	//room is made in the whole topic before locking the partition, the oldest messages may be in other partitions
+	if !restored {
+
+		result.LifetimeCapped = limits.capLifetime(messageData)
+		dropped, result.Reason = q.makeRoom(*messageData, limits)
+	}
+
+	p := q.partitionOf(messageData)
+	result.Partition = messageData.Partition
+	p.rm.Lock()
+
+	if result.Reason != "" {
+
+		result.Result = "rejected"
+
+	} else {
+
+		//offsets are assigned holding the partition lock, so that they grow along every partition
+		if !restored {
+			messageData.Offset = q.offset.Add(1)
+		} else {
+			q.advance(messageData.Offset)
+		}
+
+		//expired messages restored from db are only kept for replay
+		if !restored || time.Now().Local().Before(messageData.ExpirationTime) {
+
+			if restored {
+				q.account(1, messageSize(*messageData))
+			}
+
+			p.enqueue(*messageData)
+		}
+
+		p.log = append(p.log, *messageData)
+		result.Offset = messageData.Offset
+	}
+
+	p.rm.Unlock()
+	q.rm.RUnlock()
+
+	result.LifeTime = messageData.LifeTime
+	result.Dropped = len(dropped)
+
+	if result.Result == "rejected" || len(dropped) > 0 {
+
+		topicOverflows.WithLabelValues(messageData.Topic, limits.policy).Inc()
+		r.releaseDropped(dropped)
+	}
+
+	return result
+}
+
+//Inserting a message accepted by another node, keeping its id and offset. Returns false if already present
+func (r *Receivers) mergeMessage(message MessageData) bool {
+
+	q := r.eb.queue(message.Topic)
+
+	q.rm.RLock()
+	defer q.rm.RUnlock()
+
+	p := q.partitionOf(&message)
+
+	p.rm.Lock()
+	defer p.rm.Unlock()
+
+	if p.logged(message.ID) {
+		return false
+	}
+
+	q.advance(message.Offset)
+	p.insertLog(message)
+
+	if time.Now().Local().Before(message.ExpirationTime) {
+
+		q.account(1, messageSize(message))
+		p.enqueue(message)
+	}
+
+	return true
 }
 
-//Deleting message from db
+//Deleting message from db once topic retention is elapsed
 func (r *Receivers) deleteMessageFromDB(topic string) {
 
 	sqlStatement := `DELETE FROM messages WHERE topic = $1 AND lifetime <= $2`
-	_, err := r.dbServer.db.Exec(sqlStatement, topic, time.Now().Local())
+	result, err := r.dbServer.db.Exec(sqlStatement, topic, time.Now().Local().Add(-r.eb.retention(topic)))
 
 	if err != nil {
 
-		log.Panic(err)
+		dbErrors.WithLabelValues("delete-messages").Inc()
+		slog.Error("expired messages not deleted from db", "topic", topic, "error", err)
+		return
 	}
+
+	deleted, _ := result.RowsAffected()
+	gcRemoved.WithLabelValues("db").Add(float64(deleted))
 }
 
-//Deleting message from queue
+//Removing a message from queue, used when its persistence fails
+func (r *Receivers) removeFromQueue(topic string, id string) {
+
+	q := r.eb.queue(topic)
+	matches := func(message MessageData) bool { return message.ID == id }
+
+	q.removeMessages(matches)
+	q.removeLog(matches)
+}
+
+//Deleting message from queue, expired messages never read are moved to dead-letter queue if enabled
 func (r *Receivers) deleteMessageFromQueue(topic string) {
 
-	for i := 0; i < len(r.eb.topicMessages[topic]); {
+	now := time.Now().Local()
 
-		if time.Now().Local().After(r.eb.topicMessages[topic][i].ExpirationTime) {
+	expired := r.eb.queue(topic).removeMessages(func(message MessageData) bool {
+		return now.After(message.ExpirationTime)
+	})
 
-			r.eb.topicMessages[topic][i] = r.eb.topicMessages[topic][len(r.eb.topicMessages[topic])-1]
-			r.eb.topicMessages[topic] = r.eb.topicMessages[topic][:len(r.eb.topicMessages[topic])-1]
+	var unread MessageDataSlice
 
-		} else {
+	r.eb.rm.Lock()
+
+	for _, message := range expired {
 
-			i++
+		//only the topic owner moves messages to the dead-letter queue
+		if config().DeadLetterExpired && !r.eb.readMessages[message.ID] && r.cluster.owns(topic) {
+			unread = append(unread, message)
 		}
+
+		delete(r.eb.readMessages, message.ID)
+	}
+
+	r.eb.rm.Unlock()
+
+	gcRemoved.WithLabelValues("queue").Add(float64(len(expired)))
+	r.deleteAttachments(expired...)
+
+	for _, message := range unread {
+		r.deadLetter(message, reasonExpiredUnread)
 	}
 }
 
+//Looking for a request in requests map
+func (eb *EventBroker) findRequest(requestID string) (PublishedRequest, bool) {
+
+	eb.requestsLock.Lock()
+	request, found := eb.requests[requestID]
+	eb.requestsLock.Unlock()
+
+	return request, found
+}
+
+//Inserting a request into requests map
+func (eb *EventBroker) storeRequest(request PublishedRequest) {
+
+	eb.requestsLock.Lock()
+	eb.requests[request.RequestID] = request
+	eb.requestsLock.Unlock()
+}
+
+//Deleting a request from requests map
+func (eb *EventBroker) deleteRequest(requestID string) {
+
+	eb.requestsLock.Lock()
+	delete(eb.requests, requestID)
+	eb.requestsLock.Unlock()
+}
+
+//Adding a topic, or changing its settings if already defined
+func (eb *EventBroker) defineTopic(definition TopicDefinition) {
+
+	eb.rm.Lock()
+
+	if !stringInSlice(definition.Name, eb.topics) {
+		eb.topics = append(eb.topics, definition.Name)
+	}
+
+	eb.definitions[definition.Name] = definition
+
+	eb.rm.Unlock()
+
+	eb.resizeTopic(definition.Name)
+}
+
+func (eb *EventBroker) hasTopic(topic string) bool {
+
+	eb.rm.RLock()
+	defer eb.rm.RUnlock()
+
+	return stringInSlice(topic, eb.topics)
+}
+
+//Getting a copy of defined topics
+func (eb *EventBroker) topicList() Topics {
+
+	eb.rm.RLock()
+	defer eb.rm.RUnlock()
+
+	return append(Topics(nil), eb.topics...)
+}
+
 //Removing requests periodically for at-most-once and exactly-once semantics
-func requestGarbageCollector() {
+func (r *Receivers) requestGarbageCollector() {
 
 	for {
 
-		for item := range requests {
+		health.beat("requests")
 
-			if time.Now().Local().After(requests[item].InsertionTime.Add(time.Minute * time.Duration(requestLifetime))) {
-				delete(requests, item)
+		start := time.Now()
+		r.eb.requestsLock.Lock()
+
+		for item, request := range r.eb.requests {
+
+			if time.Now().Local().After(request.InsertionTime.Add(time.Minute * time.Duration(config().RequestLifetime))) {
+				delete(r.eb.requests, item)
+				gcRemoved.WithLabelValues("requests").Inc()
 			}
 		}
 
-		time.Sleep(time.Minute * time.Duration(eliminationPeriod))
+		r.eb.requestsLock.Unlock()
+		gcDuration.WithLabelValues("requests").Observe(time.Since(start).Seconds())
+
+		if !waitForSweep(start, func() int { return config().EliminationPeriod }) {
+			return
+		}
 	}
 }
 
 //Removing request in exactly-once semantic
-func removeRequest(c *gin.Context) {
+func (r *Receivers) removeRequest(c *gin.Context) {
 
-	checkSession(c)
+	if _, err := checkSession(c); err != nil {
+		return
+	}
 
 	var message MessageData
 	err := json.NewDecoder(c.Request.Body).Decode(&message)
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
 	}
 
-	delete(requests, message.RequestID)
+	r.completeRequest(c.Request.Context(), message.RequestID)
+}
+
+//Deleting a request completed by the client, on every node since it is stored by the topic owner
+func (r *Receivers) completeRequest(ctx context.Context, requestID string) {
+
+	err := r.applyChange(ctx, StateChange{Op: changeDeleteRequest, RequestID: requestID})
+
+	if err != nil {
+		loggerFrom(ctx).Warn("request not removed", "request_id", requestID, "error", err)
+	}
 }
 
 //Deleting expired messages from queue and db periodically
@@ -197,19 +521,35 @@ func (r *Receivers) messageGarbageCollector() {
 
 	for {
 
-		for topic := range r.eb.topicMessages {
+		health.beat("messages")
+		sweep := time.Now()
+
+		for topic := range r.eb.topicQueues() {
+
+			if !backgroundWorkers.start() {
+				return
+			}
+
+			go func(topic string) {
 
-			go func() {
+				defer backgroundWorkers.done()
 
-				if dbPersistence {
+				start := time.Now()
+
+				if config().DBPersistence {
 					r.deleteMessageFromDB(topic)
 				}
 
 				r.deleteMessageFromQueue(topic)
-			}()
+				r.deleteMessageFromLog(topic)
+
+				gcDuration.WithLabelValues("messages").Observe(time.Since(start).Seconds())
+			}(topic)
 		}
 
-		time.Sleep(time.Minute * time.Duration(garbageCollectorPeriod))
+		if !waitForSweep(sweep, func() int { return config().GarbageCollectorPeriod }) {
+			return
+		}
 	}
 }
 
@@ -222,43 +562,97 @@ func notificationsPage(c *gin.Context) {
 //Getting all user messages based on radius and subscriptions
 func (r *Receivers) notifications(c *gin.Context) {
 
-	email := checkSession(c)
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
 
 	var d MessageData
-	err := json.NewDecoder(c.Request.Body).Decode(&d)
+	err = json.NewDecoder(c.Request.Body).Decode(&d)
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
 	}
 
 	var notifications []MessageData
 
-	for _, topic := range r.eb.userTopics[email] {
+	spanCtx, span := tracer.Start(c.Request.Context(), "match notifications")
+	start := time.Now()
+
+	topics := r.eb.subscribedTopics(email)
+
+	//users removed from the members of a private topic stop receiving its messages
+	topics = r.eb.accessibleTopics(topics, email)
+	filters := r.eb.userFilters(email)
+
+	if config().PostGISEnabled {
+
+		notifications, err = r.dbServer.nearbyMessages(spanCtx, topics, d)
+
+		if err != nil {
+
+			span.End()
+			dbErrors.WithLabelValues("select-notifications").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		notifications = applyFilters(notifications, filters)
+
+	} else {
 
-		for _, message := range r.eb.topicMessages[topic] {
+		for _, topic := range topics {
 
-			if checkDistance(d.Latitude, message.Latitude, d.Longitude, message.Longitude, d.Radius, message.Radius) {
+			for _, message := range r.eb.activeMessages(topic) {
 
-				notifications = append(notifications, message)
+				if checkDistance(d.Latitude, message.Latitude, d.Longitude, message.Longitude, d.Radius, message.Radius) &&
+					filters[topic].matches(message) {
+
+					notifications = append(notifications, message)
+				}
 			}
 		}
 	}
 
+	notificationDuration.Observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("sdcc.notifications", len(notifications)))
+	span.End()
+
+	//tracking read messages for expired-unread dead letters, decided by the owner of the topic
+	if config().DeadLetterExpired && len(notifications) > 0 {
+
+		ids := make([]string, len(notifications))
+
+		for i, message := range notifications {
+			ids[i] = message.ID
+		}
+
+		r.eb.markRead(ids)
+		r.cluster.sendRead(notifications)
+	}
+
 	result, _ := json.Marshal(notifications)
 	c.Writer.Header().Set("Content-Type", "application/json")
 	_, err = c.Writer.Write(result)
 
 	if err != nil {
-		log.Panic(err)
+		loggerFrom(c.Request.Context()).Warn("response not sent", "error", err)
 	}
 }
 
 //Redirecting to subscription page with subscription info
 func (r *Receivers) subscriptionPage(c *gin.Context) {
 
-	email := checkSession(c)
+	email, err := checkSession(c)
 
-	subscribed := r.eb.userTopics[email]
+	if err != nil {
+		return
+	}
+
+	subscribed := r.eb.subscribedTopics(email)
+	filters := r.eb.userFilters(email)
 
 	tRes := Topic{}
 	var results []Topic
@@ -266,14 +660,22 @@ func (r *Receivers) subscriptionPage(c *gin.Context) {
 	for _, topic := range subscribed {
 		tRes.Name = topic
 		tRes.Flag = true
+
+		if filter := filters[topic]; filter != nil {
+			tRes.Filter = filter.expression
+		}
+
 		results = append(results, tRes)
+		tRes.Filter = ""
 	}
 
 	noSubscribed, err := r.dbServer.db.Query("select t.name from topics t where t.name "+
 		"not in (select s.topic from subscriptions s where s.subscriber = $1)", email)
 
 	if err != nil {
-		log.Panic(err)
+		dbErrors.WithLabelValues("select-topics").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
 	}
 
 	for noSubscribed.Next() {
@@ -299,28 +701,45 @@ func (r *Receivers) subscriptionPage(c *gin.Context) {
 //Editing user subscription
 func (r *Receivers) editSubscription(c *gin.Context) {
 
-	email := checkSession(c)
+	email, err := checkSession(c)
 
-	var dataEvent MessageData
-	err := json.NewDecoder(c.Request.Body).Decode(&dataEvent)
+	if err != nil {
+		return
+	}
+
+	var dataEvent SubscriptionRequest
+	err = json.NewDecoder(c.Request.Body).Decode(&dataEvent)
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
 	}
 
-	subscriptions := r.eb.userTopics[email]
+	logger := withLogFields(c, "topic", dataEvent.Topic)
+
+	subscriptions := r.eb.subscribedTopics(email)
 
 	//Deleting subscription if already subscribed
 	if stringInSlice(dataEvent.Topic, subscriptions) {
 
+		filter := r.eb.filterExpression(email, dataEvent.Topic)
+
 		sqlStatement := `DELETE FROM subscriptions WHERE subscriber = $1 AND topic = $2`
-		_, err := r.dbServer.db.Exec(sqlStatement, email, dataEvent.Topic)
+		_, err = r.dbServer.db.Exec(sqlStatement, email, dataEvent.Topic)
 
 		if err != nil {
-			log.Panic(err)
+			dbErrors.WithLabelValues("delete-subscription").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		change := StateChange{Op: changeUnsubscribe, Topic: dataEvent.Topic, Subscriber: email}
+
+		if !r.applyStoredChange(c, change, func() error { return r.storeSubscription(email, dataEvent.Topic, filter) }) {
+			return
 		}
 
-		r.topicUnsubscription(email, dataEvent.Topic)
+		logger.Info("unsubscribed")
 
 		userAgent := c.Request.Header.Get("User-Agent")
 
@@ -332,14 +751,29 @@ func (r *Receivers) editSubscription(c *gin.Context) {
 
 	} else { //Adding subscription if not subscribed yet
 
-		sqlStatement := `INSERT INTO subscriptions (subscriber, topic) VALUES ($1, $2)`
-		_, err := r.dbServer.db.Exec(sqlStatement, email, dataEvent.Topic)
+		if !r.eb.canAccess(dataEvent.Topic, email) {
+			c.JSON(http.StatusForbidden, "Not a member of private topic "+dataEvent.Topic)
+			return
+		}
 
-		if err != nil {
-			log.Panic(err)
+		if _, err = compileFilter(dataEvent.Filter); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
 		}
 
-		r.topicSubscription(dataEvent.Topic, email)
+		if err = r.storeSubscription(email, dataEvent.Topic, dataEvent.Filter); err != nil {
+			dbErrors.WithLabelValues("insert-subscription").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		change := StateChange{Op: changeSubscribe, Topic: dataEvent.Topic, Subscriber: email, Filter: dataEvent.Filter}
+
+		if !r.applyStoredChange(c, change, func() error { return r.deleteSubscription(email, dataEvent.Topic) }) {
+			return
+		}
+
+		logger.Info("subscribed")
 
 		userAgent := c.Request.Header.Get("User-Agent")
 
@@ -351,12 +785,177 @@ func (r *Receivers) editSubscription(c *gin.Context) {
 	}
 }
 
+//Writing subscription of user to topic, replacing the filter of a subscription already stored
+func (r *Receivers) storeSubscription(email string, topic string, filter string) error {
+
+	_, err := r.dbServer.db.Exec(`INSERT INTO subscriptions (subscriber, topic, filter) VALUES ($1, $2, NULLIF($3, '')) ON CONFLICT
+		(subscriber, topic) DO UPDATE SET filter = EXCLUDED.filter`, email, topic, filter)
+
+	return err
+}
+
+func (r *Receivers) deleteSubscription(email string, topic string) error {
+
+	_, err := r.dbServer.db.Exec(`DELETE FROM subscriptions WHERE subscriber = $1 AND topic = $2`, email, topic)
+
+	return err
+}
+
+//Applying a change whose rows are already written to db. A change that cannot be applied, e.g. without a Raft leader, is
+//undone in db, so that db and nodes agree and the request can be sent again
+func (r *Receivers) applyStoredChange(c *gin.Context, change StateChange, undo func() error) bool {
+
+	err := r.applyChange(c.Request.Context(), change)
+
+	if err == nil {
+		return true
+	}
+
+	if undoErr := undo(); undoErr != nil {
+
+		dbErrors.WithLabelValues("undo-change").Inc()
+		loggerFrom(c.Request.Context()).Error("change not undone in db", "op", change.Op, "error", undoErr)
+	}
+
+	failRequest(c, http.StatusServiceUnavailable, err)
+	return false
+}
+
+//Changing filter of a subscription of the user, an empty Filter removes it
+func (r *Receivers) setSubscriptionFilter(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var request SubscriptionRequest
+	err = json.NewDecoder(c.Request.Body).Decode(&request)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	logger := withLogFields(c, "topic", request.Topic)
+
+	if _, err = compileFilter(request.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	previous := r.eb.filterExpression(email, request.Topic)
+	updateFilter := `UPDATE subscriptions SET filter = NULLIF($3, '') WHERE subscriber = $1 AND topic = $2`
+	result, err := r.dbServer.db.Exec(updateFilter, email, request.Topic, request.Filter)
+
+	if err != nil {
+		dbErrors.WithLabelValues("update-subscription").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		c.JSON(http.StatusNotFound, "Not subscribed to "+request.Topic)
+		return
+	}
+
+	change := StateChange{Op: changeSubscribe, Topic: request.Topic, Subscriber: email, Filter: request.Filter}
+
+	if !r.applyStoredChange(c, change, func() error {
+
+		_, err := r.dbServer.db.Exec(updateFilter, email, request.Topic, previous)
+		return err
+	}) {
+		return
+	}
+
+	logger.Info("subscription filter changed", "filter", request.Filter)
+	c.JSON(http.StatusOK, request)
+}
+
+//Creating a topic or changing its settings, on every node
+func (r *Receivers) saveTopic(c *gin.Context) {
+
+	var topic TopicDefinition
+	err := json.NewDecoder(c.Request.Body).Decode(&topic)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	topic.Schema = normalizeSchema(topic.Schema)
+
+	if err = topic.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger := withLogFields(c, "topic", topic.Name)
+
+	r.eb.rm.RLock()
+	previous, defined := r.eb.definitions[topic.Name]
+	r.eb.rm.RUnlock()
+
+	if err = r.storeTopic(topic); err != nil {
+		dbErrors.WithLabelValues("save-topic").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	change := StateChange{Op: changeDefineTopic, Topic: topic.Name, Definition: &topic}
+
+	if !r.applyStoredChange(c, change, func() error {
+
+		if defined {
+			return r.storeTopic(previous)
+		}
+
+		_, err := r.dbServer.db.Exec(`DELETE FROM topics WHERE name = $1`, topic.Name)
+		return err
+	}) {
+		return
+	}
+
+	logger.Info("topic saved")
+	c.JSON(http.StatusOK, topic)
+}
+
+//Writing settings of topic, replacing the ones already stored
+func (r *Receivers) storeTopic(topic TopicDefinition) error {
+
+	schema := sql.NullString{String: string(topic.Schema), Valid: len(topic.Schema) > 0}
+
+	_, err := r.dbServer.db.Exec(`INSERT INTO topics (name, retention, partitions, max_lifetime, max_messages, max_bytes,
+		overflow_policy, max_radius, schema, private, members) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT
+		(name) DO UPDATE SET retention = EXCLUDED.retention, partitions = EXCLUDED.partitions, max_lifetime = EXCLUDED.max_lifetime,
+		max_messages = EXCLUDED.max_messages, max_bytes = EXCLUDED.max_bytes, overflow_policy = EXCLUDED.overflow_policy,
+		max_radius = EXCLUDED.max_radius, schema = EXCLUDED.schema, private = EXCLUDED.private, members = EXCLUDED.members`,
+		topic.Name, topic.Retention, topic.Partitions, topic.MaxLifetime, topic.MaxMessages, topic.MaxBytes, topic.OverflowPolicy,
+		topic.MaxRadius, schema, topic.Private, pq.Array(topic.Members))
+
+	return err
+}
+
 //Redirecting to publish page
 func (r *Receivers) publishPage(c *gin.Context) {
 
-	email := checkSession(c)
+	email, err := checkSession(c)
 
-	results := GlobalTopics
+	if err != nil {
+		return
+	}
+
+	//the page cannot encrypt, private topics are published to through the client SDK
+	var results Topics
+
+	for _, topic := range r.eb.topicList() {
+
+		if !r.eb.isPrivate(topic) {
+			results = append(results, topic)
+		}
+	}
 
 	c.HTML(
 		http.StatusOK,
@@ -366,9 +965,9 @@ func (r *Receivers) publishPage(c *gin.Context) {
 			"status":           "logged",
 			"results":          results,
 			"email":            email,
-			"deliverySemantic": deliverySemantic,
-			"deliveryTimeout":  deliveryTimeout,
-			"retryLimit":       retryLimit,
+			"deliverySemantic": config().DeliverySemantic,
+			"deliveryTimeout":  config().DeliveryTimeout,
+			"retryLimit":       config().RetryLimit,
 		},
 	)
 }
@@ -376,205 +975,418 @@ func (r *Receivers) publishPage(c *gin.Context) {
 //Publishing message according to semantic
 func (r *Receivers) publish(c *gin.Context) {
 
-	checkSession(c)
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
 
 	var message MessageData
-	err := json.NewDecoder(c.Request.Body).Decode(&message)
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		err = readMultipartMessage(c, &message)
+	} else {
+		err = json.NewDecoder(c.Request.Body).Decode(&message)
+	}
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	withLogFields(c, "topic", message.Topic)
+	normalizePayload(&message)
+
+	if !r.eb.canAccess(message.Topic, email) {
+
+		c.JSON(http.StatusForbidden, PublishResult{Result: "rejected", Reason: "not a member of private topic " + message.Topic})
+		return
+	}
+
+	if err = r.eb.validateMessage(message); err != nil {
+
+		c.JSON(http.StatusBadRequest, PublishResult{Result: "rejected", Reason: err.Error()})
+		return
+	}
+
+	if err = r.checkKeyVersion(c.Request.Context(), message); errors.Is(err, errUnknownKeyVersion) {
+
+		c.JSON(http.StatusBadRequest, PublishResult{Result: "rejected", Reason: err.Error()})
+		return
+
+	} else if err != nil {
+
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !checkPublishLimits(c, email, message.Topic) {
+		return
+	}
+
+	if err = r.storeAttachments(c, &message); err != nil {
+
+		c.JSON(http.StatusBadRequest, PublishResult{Result: "rejected", Reason: err.Error()})
+		return
+	}
+
+	published := r.routeMessage(c.Request.Context(), message, config().DeliverySemantic)
+
+	//attachments of messages not stored, also duplicates of stored ones, are not referenced by any message
+	if published.Result != "success" || published.Offset == 0 {
+		r.deleteAttachments(message)
+	}
+
+	result, _ := json.Marshal(published)
+	c.Writer.Header().Set("Content-Type", "application/json")
+	_, err = c.Writer.Write(result)
+
+	if err != nil {
+		loggerFrom(c.Request.Context()).Warn("response not sent", "error", err)
+	}
+}
+
+//Inserting message into queue and db according to semantic
+func (r *Receivers) publishMessage(ctx context.Context, message MessageData, semantic string) PublishResult {
+
+	ctx, span := tracer.Start(ctx, "publish "+message.Topic, trace.WithAttributes(
+		attribute.String("messaging.destination.name", message.Topic),
+		attribute.String("sdcc.delivery_semantic", semantic)))
+	defer span.End()
+
+	normalizePayload(&message)
+
+	//messages not matching the schema of the topic are rejected on every entry point, also MQTT and replays
+	if err := r.eb.validatePayload(message); err != nil {
+
+		publishedMessages.WithLabelValues(message.Topic, semantic, "rejected").Inc()
+		loggerFrom(ctx).Info("message rejected", "topic", message.Topic, "reason", err)
+		r.deadLetter(message, reasonRejected)
+
+		return PublishResult{Result: "rejected", Reason: err.Error()}
 	}
 
 	found := true
 
-	if deliverySemantic != "at-least-once" {
+	if semantic != "at-least-once" {
 
 		//checking if request is duplicate
-		_, found = requests[message.RequestID]
+		_, found = r.eb.findRequest(message.RequestID)
+
+		if found {
+			duplicateRequests.WithLabelValues(message.Topic, semantic).Inc()
+		}
 	}
 
-	returnValue := "fail"
+	result := PublishResult{Result: "fail"}
 
-	if deliverySemantic == "at-least-once" || !found {
+	if semantic == "at-least-once" || !found {
 
-		expirationTime := time.Now().Local().Add(time.Minute * time.Duration(message.LifeTime))
+		message.ID = uuid.NewV4().String()
+		message.Offset = 0
+		message.InsertionTime = time.Now().Local()
+		message.ExpirationTime = message.InsertionTime.Add(time.Minute * time.Duration(message.LifeTime))
 		var msgID int
 
-		ch := make(chan bool)
+		span.SetAttributes(attribute.String("messaging.message.id", message.ID))
+		injectTraceContext(ctx, &message)
+
+		ch := make(chan PublishResult)
 
 		go func() {
-			ch <- r.publishTo(message)
+			_, queueSpan := tracer.Start(ctx, "queue insert")
+			ch <- r.publishTo(&message)
+			queueSpan.End()
 		}()
 
-		checked := <-ch
+		result = <-ch
 
 		//checking if queue insertion is successful
-		if checked {
-
-			//inserting in requests map for at-most-once and exactly-once semantics
-			if deliverySemantic != "at-least-once" {
-				message.InsertionTime = time.Now().Local()
-				requests[message.RequestID] = message
-			}
-
-			if dbPersistence {
+		if result.Result == "success" {
 
-				err = r.dbServer.db.QueryRow(`INSERT INTO messages (payload, topic, radius, latitude, longitude, lifetime, title) 
-					VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`, message.Message, message.Topic, message.Radius, message.Latitude,
-					message.Longitude, expirationTime, message.Title).Scan(&msgID)
+			if config().DBPersistence {
 
-				if err == nil {
+				sqlCtx, sqlSpan := startSQLSpan(ctx, "INSERT", "messages")
 
-					returnValue = "success"
+				headers, body, attachments := jsonColumn(message.Headers), documentColumn(message.Body), jsonColumn(message.Attachments)
 
-				}
+				err := r.dbServer.db.QueryRowContext(sqlCtx, `INSERT INTO messages (payload, topic, radius, latitude, longitude, lifetime, title,
+					topic_offset, insertion_time, message_id, partition_key, content_type, headers, body, data, attachments, encryption)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), $12, $13, $14, $15, $16, $17) RETURNING id`,
+					message.Message, message.Topic, message.Radius, message.Latitude, message.Longitude, message.ExpirationTime,
+					message.Title, message.Offset, message.InsertionTime, message.ID, message.PartitionKey, message.ContentType, headers,
+					body, message.Data, attachments, jsonColumn(message.Encryption)).Scan(&msgID)
 
-			} else {
+				endSpan(sqlSpan, err)
 
-				returnValue = "success"
+				//message not persisted is removed from queue, the client will send it again
+				if err != nil {
 
+					dbErrors.WithLabelValues("insert-message").Inc()
+					loggerFrom(ctx).Error("message not persisted", "topic", message.Topic, "error", err)
+					r.removeFromQueue(message.Topic, message.ID)
+					r.deadLetter(message, reasonPersistenceFailed)
+					result = PublishResult{Result: "fail"}
+				}
 			}
 
-		} else {
+			if result.Result == "success" {
 
-			if dbPersistence {
+				//inserting in requests map for at-most-once and exactly-once semantics
+				if semantic != "at-least-once" {
 
-				sqlStatement := `DELETE FROM messages WHERE id = $1`
-				_, err := r.dbServer.db.Exec(sqlStatement, msgID)
+					request := PublishedRequest{RequestID: message.RequestID, Topic: message.Topic, Offset: message.Offset,
+						InsertionTime: message.InsertionTime}
 
-				if err != nil {
-					log.Panic(err)
+					err := r.applyChange(ctx, StateChange{Op: changeStoreRequest, Request: &request})
+
+					if err != nil {
+						loggerFrom(ctx).Warn("request not replicated", "request_id", message.RequestID, "error", err)
+					}
 				}
+
+				r.eb.notifyListeners(message)
 			}
 
-			returnValue = "fail"
+		} else {
+
+			//messages refused by the limits of the topic
+			r.deadLetter(message, reasonRejected)
 		}
 
 	} else {
 
-		returnValue = "success"
+		result.Result = "success"
 	}
 
-	result, _ := json.Marshal(returnValue)
-	c.Writer.Header().Set("Content-Type", "application/json")
-	_, err = c.Writer.Write(result)
+	publishedMessages.WithLabelValues(message.Topic, semantic, result.Result).Inc()
+	span.SetAttributes(attribute.String("sdcc.result", result.Result), attribute.Bool("sdcc.duplicate", found && semantic != "at-least-once"))
+
+	if result.Reason != "" {
+		loggerFrom(ctx).Info("message rejected", "topic", message.Topic, "reason", result.Reason)
+	}
+
+	return result
+}
+
+//Reading topics and their settings from db
+func (r *Receivers) loadTopics() error {
+
+	rows, err := r.dbServer.db.Query(`SELECT name, retention, partitions, max_lifetime, max_messages, max_bytes, overflow_policy,
+		max_radius, schema, private, members FROM topics`)
 
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var topic string
+		var retention, partitions, maxLifetime, maxMessages, maxBytes, maxRadius sql.NullInt64
+		var policy, schema sql.NullString
+		var private bool
+		var members []string
+
+		if err = rows.Scan(&topic, &retention, &partitions, &maxLifetime, &maxMessages, &maxBytes, &policy, &maxRadius,
+			&schema, &private, pq.Array(&members)); err != nil {
+			return err
+		}
+
+		definition := TopicDefinition{
+			Name:        topic,
+			Retention:   nullableInt(retention),
+			Partitions:  nullableInt(partitions),
+			MaxLifetime: nullableInt(maxLifetime),
+			MaxMessages: nullableInt(maxMessages),
+			MaxRadius:   nullableInt(maxRadius),
+			Private:     private,
+			Members:     members,
+		}
+
+		if schema.Valid {
+			definition.Schema = json.RawMessage(schema.String)
+		}
+
+		if maxBytes.Valid {
+			definition.MaxBytes = &maxBytes.Int64
+		}
+
+		if policy.Valid {
+			definition.OverflowPolicy = &policy.String
+		}
+
+		r.eb.defineTopic(definition)
+	}
+
+	return rows.Err()
 }
 
 //Initializing event broker on application start-up
 func (r *Receivers) initEB() {
 
-	messages, err := r.dbServer.db.Query("SELECT * FROM messages")
+	//topics are read first, so that messages are loaded in the partitions of their topic
+	if err := r.loadTopics(); err != nil {
+		fatal("topics not loaded", err)
+	}
+
+	rows, err := r.dbServer.db.Query(`SELECT ` + messageColumns + ` FROM messages ORDER BY topic_offset NULLS FIRST, id`)
+
+	if err != nil {
+		fatal("messages not loaded", err)
+	}
+
+	messages, err := scanMessages(rows)
 
 	if err != nil {
-		log.Panic(err)
+		fatal("messages not loaded", err)
 	}
 
-	for messages.Next() {
-		var payload, topic, title, id, latitude, longitude string
-		var radius int
-		var lifetime time.Time
-		_ = messages.Scan(&payload, &topic, &id, &radius, &latitude, &longitude, &lifetime, &title)
+	for i := range messages {
 
-		latitudeFloat, _ := strconv.ParseFloat(latitude, 64)
-		longitudeFloat, _ := strconv.ParseFloat(longitude, 64)
+		messageData := &messages[i]
 
-		messageData := MessageData{
-			Message:        payload,
-			Title:          title,
-			Topic:          topic,
-			Radius:         radius,
-			ExpirationTime: lifetime,
-			Latitude:       latitudeFloat,
-			Longitude:      longitudeFloat,
+		//messages persisted before offsets were introduced get a new one
+		if messageData.Offset == 0 {
+			messageData.Offset = r.eb.lastOffset(messageData.Topic) + 1
 		}
 
 		r.publishTo(messageData)
 
+		//attachments of messages expired while the broker was stopped are deleted as the garbage collector would have done
+		if time.Now().Local().After(messageData.ExpirationTime) {
+			r.deleteAttachments(*messageData)
+		}
 	}
 
-	subscriptions, err := r.dbServer.db.Query("SELECT * FROM subscriptions ORDER BY topic")
+	subscriptions, err := r.dbServer.db.Query("SELECT subscriber, topic, COALESCE(filter, '') FROM subscriptions ORDER BY topic")
 
 	if err != nil {
-		log.Panic(err)
+		fatal("subscriptions not loaded", err)
 	}
 
 	for subscriptions.Next() {
 
-		var subscriber, topic string
-		_ = subscriptions.Scan(&subscriber, &topic)
-		r.topicSubscription(topic, subscriber)
-	}
+		var subscriber, topic, filter string
 
-	data, err := r.dbServer.db.Query("SELECT name FROM topics ")
+		if err = subscriptions.Scan(&subscriber, &topic, &filter); err != nil {
+			fatal("subscriptions not loaded", err)
+		}
 
-	if err != nil {
-		log.Panic(err)
+		r.topicSubscription(topic, subscriber)
+		r.eb.setFilter(subscriber, topic, filter)
 	}
 
-	for data.Next() {
-		var topic string
-		_ = data.Scan(&topic)
-		GlobalTopics = append(GlobalTopics, topic)
+	if err = subscriptions.Err(); err != nil {
+		fatal("subscriptions not loaded", err)
 	}
+
+	health.setLoaded()
 }
 
 func main() {
 
+	args := loadConfig(os.Args[1:])
+	initLogging()
+
+	if len(args) > 0 && args[0] == "migrate" {
+
+		runMigrate(args[1:])
+		return
+	}
+
+	initTracing()
 	initRedis()
 	s, db := initDB()
-	defer db.Close()
 
-	var eb = &EventBroker{
-		topicMessages: map[string]MessageDataSlice{},
-		userTopics:    map[string]Topics{},
+	if config().PostgresAutoMigrate {
+
+		if err := migrateUp(db); err != nil {
+			fatal("migration failed", err)
+		}
+	}
+
+	if config().PostGISEnabled {
+		s.setupPostGIS()
 	}
 
 	var r = &Receivers{
 		dbServer: *s,
-		eb:       *eb,
+		eb:       newEventBroker(),
 	}
 
-	r.initEB()
-
-	go r.messageGarbageCollector() //go routine for message garbage collector
-	go requestGarbageCollector()   //go routine for requests garbage collector
+	//probes are answered while the event broker loads, so that readiness reports it instead of refusing connections
+	handler := r.newStartupHandler()
+	server := &http.Server{Addr: ":" + config().AppListeningPort, Handler: handler}
+	serverErrors := listen(server)
 
-	logFile, err := os.OpenFile("../log/server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	slog.Info("listening", "port", config().AppListeningPort)
 
-	if err != nil {
-		log.Fatal(err)
+	r.initBlobs()
+	r.initEB()
+	r.initDeadLetters()
+	r.initWebhooks()
+	r.initMetrics()
+	r.initCluster()
+	r.initFanout()
+
+	if config().MQTTEnabled {
+		r.initMQTT()
 	}
 
-	log.SetOutput(logFile)
+	go r.messageGarbageCollector() //go routine for message garbage collector
+	go r.requestGarbageCollector() //go routine for requests garbage collector
 
-	router.Use(gin.LoggerWithWriter(logFile))
+	router.Use(gin.RecoveryWithWriter(logWriter))
+	router.Use(TracingMiddleware())
+	router.Use(RequestLoggerMiddleware())
 
 	router.StaticFS("/static/", http.Dir("../static"))
 	router.LoadHTMLGlob("../templates/*")
 
 	router.GET("/", loginPage)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", r.readyz)
 	router.GET("/registrationPage", registrationPage)
 	router.GET("/logout", TokenAuthMiddleware(), logout)
 	router.GET("/publishPage", TokenAuthMiddleware(), r.publishPage)
 	router.GET("/subscriptionPage", TokenAuthMiddleware(), r.subscriptionPage)
 	router.GET("/notificationsPage", TokenAuthMiddleware(), notificationsPage)
+	router.GET("/replay", TokenAuthMiddleware(), r.replay)
+	router.GET("/webhooks", TokenAuthMiddleware(), r.webhooks)
+	router.GET("/webhookDeadLetters", TokenAuthMiddleware(), webhookDeadLetters)
+	router.GET("/deadLetters", TokenAuthMiddleware(), AdminMiddleware(), r.deadLetters)
+	router.GET("/raft", TokenAuthMiddleware(), AdminMiddleware(), r.raftStatus)
+	router.GET("/attachments/:id", TokenAuthMiddleware(), r.attachment)
+	router.GET("/publicKeys", TokenAuthMiddleware(), r.publicKeys)
+	router.GET("/topicKey", TokenAuthMiddleware(), r.topicKey)
 
 	router.POST("/login", s.login)
 	router.POST("/registration", s.registration)
 	router.POST("/publish", TokenAuthMiddleware(), r.publish)
 	router.POST("/editSubscription", TokenAuthMiddleware(), r.editSubscription)
+	router.POST("/search", TokenAuthMiddleware(), r.search)
+	router.POST("/subscriptionFilter", TokenAuthMiddleware(), r.setSubscriptionFilter)
 	router.POST("/notifications", TokenAuthMiddleware(), r.notifications)
-	router.POST("/removeRequest", TokenAuthMiddleware(), removeRequest)
-
-	log.Println("Listening on :", listeningPort)
-	err = router.Run(":" + listeningPort)
-
-	if err != nil {
-
-		log.Fatal(err)
-	}
+	router.POST("/removeRequest", TokenAuthMiddleware(), r.removeRequest)
+	router.POST("/registerWebhook", TokenAuthMiddleware(), r.registerWebhook)
+	router.POST("/removeWebhook", TokenAuthMiddleware(), r.removeWebhook)
+	router.POST("/publicKey", TokenAuthMiddleware(), r.registerPublicKey)
+	router.POST("/topicKeys", TokenAuthMiddleware(), r.saveTopicKeys)
+	router.POST("/replayDeadLetters", TokenAuthMiddleware(), AdminMiddleware(), r.replayDeadLetters)
+	router.POST("/purgeDeadLetters", TokenAuthMiddleware(), AdminMiddleware(), r.purgeDeadLetters)
+	router.POST("/reloadConfig", TokenAuthMiddleware(), AdminMiddleware(), reloadConfiguration)
+	router.POST("/topics", TokenAuthMiddleware(), AdminMiddleware(), r.saveTopic)
+
+	router.GET("/internal/state", ClusterMiddleware(), r.internalState)
+	router.POST("/internal/publish", ClusterMiddleware(), r.internalPublish)
+	router.POST("/internal/replicate", ClusterMiddleware(), r.internalReplicate)
+	router.POST("/internal/raft/apply", ClusterMiddleware(), r.internalRaftApply)
+
+	handler.router.Store(router)
+	slog.Info("event broker loaded, serving every route")
+
+	r.serve(server, serverErrors, db)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+)
+
+var publishedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_published_messages_total",
+	Help: "Publish requests by topic, delivery semantic and result.",
+}, []string{"topic", "semantic", "result"})
+
+var duplicateRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_duplicate_requests_total",
+	Help: "Publish requests suppressed because their RequestID was already received.",
+}, []string{"topic", "semantic"})
+
+var notificationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "sdcc_notification_query_duration_seconds",
+	Help:    "Time spent matching notifications for a user.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+})
+
+var gcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "sdcc_gc_sweep_duration_seconds",
+	Help:    "Duration of garbage collector sweeps.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+}, []string{"collector"})
+
+var gcRemoved = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_gc_removed_total",
+	Help: "Items removed by garbage collectors by store (queue, log, db, requests).",
+}, []string{"store"})
+
+var dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_db_errors_total",
+	Help: "Postgres errors by operation.",
+}, []string{"operation"})
+
+var redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_redis_errors_total",
+	Help: "Redis errors by command.",
+}, []string{"command"})
+
+var topicOverflows = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_topic_overflows_total",
+	Help: "Publishes that reached max-messages or max-bytes of a topic, by topic and overflow policy.",
+}, []string{"topic", "policy"})
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_rate_limited_total",
+	Help: "Publishes answered with 429 by exceeded limit (user, api-key, topic, daily).",
+}, []string{"limit"})
+
+var fanoutMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_fanout_messages_total",
+	Help: "Messages sent to and received from other instances on the Redis fan-out channel, by result.",
+}, []string{"result"})
+
+var blobErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sdcc_blob_errors_total",
+	Help: "Failed blob store operations on attachments, by operation.",
+}, []string{"operation"})
+
+//Collector reading queue depth and active sessions at scrape time
+type brokerCollector struct {
+	eb         *EventBroker
+	queueDepth *prometheus.Desc
+	sessions   *prometheus.Desc
+}
+
+//Counting failed Redis commands, missing keys are not errors
+type redisMetricsHook struct{}
+
+//Registering collectors reading broker state
+func (r *Receivers) initMetrics() {
+
+	prometheus.MustRegister(&brokerCollector{
+		eb: r.eb,
+		queueDepth: prometheus.NewDesc("sdcc_queue_depth", "Active messages in queue by topic.",
+			[]string{"topic"}, nil),
+		sessions: prometheus.NewDesc("sdcc_active_sessions", "Unexpired user sessions stored in Redis.", nil, nil),
+	})
+}
+
+func (bc *brokerCollector) Describe(ch chan<- *prometheus.Desc) {
+
+	ch <- bc.queueDepth
+	ch <- bc.sessions
+}
+
+func (bc *brokerCollector) Collect(ch chan<- prometheus.Metric) {
+
+	for topic, q := range bc.eb.topicQueues() {
+		ch <- prometheus.MustNewConstMetric(bc.queueDepth, prometheus.GaugeValue, float64(q.depth()), topic)
+	}
+
+	sessions, err := countSessions(ctx)
+
+	if err != nil {
+
+		slog.Error("sessions not counted", "error", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(bc.sessions, prometheus.GaugeValue, float64(sessions))
+}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+
+	return ctx, nil
+}
+
+func (redisMetricsHook) AfterProcess(_ context.Context, cmd redis.Cmder) error {
+
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(cmd.Name()).Inc()
+	}
+
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+
+	return ctx, nil
+}
+
+func (h redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+
+	for _, cmd := range cmds {
+		_ = h.AfterProcess(ctx, cmd)
+	}
+
+	return nil
+}
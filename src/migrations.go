@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Migrations are named <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//Arbitrary key of the advisory lock held while migrating, so that instances starting together do not race
+const migrationLockKey = 725_140_337
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+//Reading embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+
+	files, err := migrationFiles.ReadDir("migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+
+	for _, file := range files {
+
+		name := file.Name()
+		parts := strings.SplitN(name, "_", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>.up.sql or .down.sql", name)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		m, found := byVersion[version]
+
+		if !found {
+			m = &migration{version: version}
+			byVersion[version] = m
+		}
+
+		switch {
+
+		case strings.HasSuffix(parts[1], ".up.sql"):
+			m.name = strings.TrimSuffix(parts[1], ".up.sql")
+			m.up = string(content)
+
+		case strings.HasSuffix(parts[1], ".down.sql"):
+			m.down = string(content)
+
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql suffix", name)
+		}
+	}
+
+	var migrations []migration
+
+	for _, m := range byVersion {
+
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d: up script missing", m.version)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+//Running fn on a single connection holding the migration lock, with schema version table created
+func withMigrationLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+
+	conn, err := db.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp NOT NULL DEFAULT now())`)
+
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+//Getting versions already applied
+func appliedMigrations(conn *sql.Conn) (map[int]bool, error) {
+
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int]bool{}
+
+	for rows.Next() {
+
+		var version int
+
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+//Running a migration script and recording it in one transaction
+func runMigration(conn *sql.Conn, m migration, script string, record string, args ...interface{}) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	//scripts are sent with the simple query protocol, so they can hold several statements
+	if _, err = tx.Exec(script); err == nil {
+		_, err = tx.Exec(record, args...)
+	}
+
+	if err != nil {
+
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+	}
+
+	return tx.Commit()
+}
+
+//Applying all pending migrations
+func migrateUp(db *sql.DB) error {
+
+	migrations, err := loadMigrations()
+
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+
+		applied, err := appliedMigrations(conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+
+			if applied[m.version] {
+				continue
+			}
+
+			err = runMigration(conn, m, m.up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name)
+
+			if err != nil {
+				return err
+			}
+
+			slog.Info("migration applied", "version", m.version, "name", m.name)
+		}
+
+		return nil
+	})
+}
+
+//Reverting the last steps applied migrations
+func migrateDown(db *sql.DB, steps int) error {
+
+	migrations, err := loadMigrations()
+
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+
+		applied, err := appliedMigrations(conn)
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+
+			m := migrations[i]
+
+			if !applied[m.version] {
+				continue
+			}
+
+			if m.down == "" {
+				return fmt.Errorf("migration %04d_%s: down script missing", m.version, m.name)
+			}
+
+			err = runMigration(conn, m, m.down, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+
+			if err != nil {
+				return err
+			}
+
+			slog.Info("migration reverted", "version", m.version, "name", m.name)
+			steps--
+		}
+
+		return nil
+	})
+}
+
+//Printing applied and pending migrations
+func migrationStatus(db *sql.DB) error {
+
+	migrations, err := loadMigrations()
+
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+
+		applied, err := appliedMigrations(conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+
+			status := "pending"
+
+			if applied[m.version] {
+				status = "applied"
+			}
+
+			fmt.Printf("%04d_%s\t%s\n", m.version, m.name, status)
+		}
+
+		return nil
+	})
+}
+
+//Handling migrate subcommand: migrate [up | down [steps] | status]
+func runMigrate(args []string) {
+
+	_, db := initDB()
+	defer db.Close()
+
+	command := "up"
+
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	var err error
+
+	switch command {
+
+	case "up":
+		err = migrateUp(db)
+
+	case "down":
+
+		steps := 1
+
+		if len(args) > 1 {
+
+			steps, err = strconv.Atoi(args[1])
+
+			if err != nil || steps <= 0 {
+
+				fmt.Fprintln(os.Stderr, "usage: migrate down [steps]")
+				os.Exit(2)
+			}
+		}
+
+		err = migrateDown(db, steps)
+
+	case "status":
+		err = migrationStatus(db)
+
+	default:
+		fmt.Fprintln(os.Stderr, "usage: migrate [up | down [steps] | status]")
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fatal("migration failed", err)
+	}
+}
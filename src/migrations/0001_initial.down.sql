@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "public"."subscriptions";
+DROP TABLE IF EXISTS "public"."messages";
+DROP TABLE IF EXISTS "public"."users";
+DROP TABLE IF EXISTS "public"."topics";
+DROP SEQUENCE IF EXISTS messages_id_seq;
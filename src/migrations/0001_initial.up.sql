@@ -1,17 +1,15 @@
--- Adminer 4.7.7 PostgreSQL dump
-
-CREATE SEQUENCE messages_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 2147483647 START 363 CACHE 1;
+CREATE SEQUENCE IF NOT EXISTS messages_id_seq INCREMENT 1 MINVALUE 1 MAXVALUE 2147483647 START 1 CACHE 1;
 
 CREATE TABLE IF NOT EXISTS "public"."topics" (
     "name" text NOT NULL,
     CONSTRAINT "topics_pk" PRIMARY KEY ("name")
-) WITH (oids = false);
+);
 
 CREATE TABLE IF NOT EXISTS "public"."users" (
     "email" text NOT NULL,
     "password" text,
     CONSTRAINT "users_pk" PRIMARY KEY ("email")
-) WITH (oids = false);
+);
 
 CREATE TABLE IF NOT EXISTS "public"."messages" (
     "payload" text,
@@ -24,7 +22,7 @@ CREATE TABLE IF NOT EXISTS "public"."messages" (
     "title" text,
     CONSTRAINT "messages_pk" PRIMARY KEY ("id"),
     CONSTRAINT "messages_topics_name_fk" FOREIGN KEY (topic) REFERENCES topics(name) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE
-) WITH (oids = false);
+);
 
 CREATE TABLE IF NOT EXISTS "public"."subscriptions" (
     "subscriber" text NOT NULL,
@@ -32,7 +30,7 @@ CREATE TABLE IF NOT EXISTS "public"."subscriptions" (
     CONSTRAINT "subscriptions_pk" PRIMARY KEY ("subscriber", "topic"),
     CONSTRAINT "subscriptions_topics_name_fk" FOREIGN KEY (topic) REFERENCES topics(name) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE,
     CONSTRAINT "subscriptions_users_email_fk" FOREIGN KEY (subscriber) REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE
-) WITH (oids = false);
+);
 
 INSERT INTO "topics" ("name") VALUES
 ('Elettronica'),
@@ -52,4 +50,4 @@ INSERT INTO "topics" ("name") VALUES
 ('Moto'),
 ('Casa'),
 ('Videogames')
-ON CONFLICT DO NOTHING;
\ No newline at end of file
+ON CONFLICT DO NOTHING;
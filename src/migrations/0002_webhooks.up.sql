@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "public"."webhooks" (
+    "id" serial NOT NULL,
+    "subscriber" text NOT NULL,
+    "topic" text NOT NULL,
+    "url" text NOT NULL,
+    "secret" text NOT NULL,
+    "radius" integer DEFAULT 0 NOT NULL,
+    "latitude" double precision DEFAULT 0 NOT NULL,
+    "longitude" double precision DEFAULT 0 NOT NULL,
+    CONSTRAINT "webhooks_pk" PRIMARY KEY ("id"),
+    CONSTRAINT "webhooks_topics_name_fk" FOREIGN KEY (topic) REFERENCES topics(name) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE,
+    CONSTRAINT "webhooks_users_email_fk" FOREIGN KEY (subscriber) REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS "public"."dead_letters" (
+    "id" text NOT NULL,
+    "topic" text NOT NULL,
+    "reason" text NOT NULL,
+    "failed_at" timestamp NOT NULL,
+    "message" jsonb NOT NULL,
+    CONSTRAINT "dead_letters_pk" PRIMARY KEY ("id")
+);
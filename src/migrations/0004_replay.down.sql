@@ -0,0 +1,5 @@
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "insertion_time";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "topic_offset";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "retention";
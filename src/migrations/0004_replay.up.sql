@@ -0,0 +1,5 @@
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "retention" integer;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "topic_offset" bigint;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "insertion_time" timestamp;
@@ -0,0 +1,3 @@
+ALTER TABLE "public"."messages"
+    ALTER COLUMN "latitude" TYPE text USING "latitude"::text,
+    ALTER COLUMN "longitude" TYPE text USING "longitude"::text;
@@ -0,0 +1,3 @@
+ALTER TABLE "public"."messages"
+    ALTER COLUMN "latitude" TYPE double precision USING NULLIF(trim("latitude"), '')::double precision,
+    ALTER COLUMN "longitude" TYPE double precision USING NULLIF(trim("longitude"), '')::double precision;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "public"."messages_message_id_idx";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "message_id";
@@ -0,0 +1,5 @@
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "message_id" text;
+
+UPDATE "public"."messages" SET "message_id" = 'legacy-' || "id" WHERE "message_id" IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS "messages_message_id_idx" ON "public"."messages" ("message_id");
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS "messages_position_trigger" ON "public"."messages";
+
+DROP FUNCTION IF EXISTS messages_set_position();
+
+DROP INDEX IF EXISTS "public"."messages_position_idx";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "position";
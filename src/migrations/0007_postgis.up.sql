@@ -0,0 +1,38 @@
+-- Skipped when PostGIS is not installed on the server, postgis-enabled then runs it again at start-up and fails if the
+-- extension cannot be created. Every statement is idempotent
+DO $migration$
+BEGIN
+
+    IF NOT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'postgis') THEN
+        RETURN;
+    END IF;
+
+    CREATE EXTENSION IF NOT EXISTS postgis;
+
+    EXECUTE 'ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "position" geography(Point, 4326)';
+
+    EXECUTE $sql$
+        CREATE OR REPLACE FUNCTION messages_set_position() RETURNS trigger AS $body$
+        BEGIN
+            IF NEW.latitude IS NULL OR NEW.longitude IS NULL THEN
+                NEW.position := NULL;
+            ELSE
+                NEW.position := ST_SetSRID(ST_MakePoint(NEW.longitude, NEW.latitude), 4326)::geography;
+            END IF;
+            RETURN NEW;
+        END
+        $body$ LANGUAGE plpgsql
+    $sql$;
+
+    DROP TRIGGER IF EXISTS "messages_position_trigger" ON "public"."messages";
+
+    CREATE TRIGGER "messages_position_trigger" BEFORE INSERT OR UPDATE OF latitude, longitude ON "public"."messages"
+        FOR EACH ROW EXECUTE PROCEDURE messages_set_position();
+
+    EXECUTE 'UPDATE "public"."messages" SET latitude = latitude
+        WHERE position IS NULL AND latitude IS NOT NULL AND longitude IS NOT NULL';
+
+    EXECUTE 'CREATE INDEX IF NOT EXISTS "messages_position_idx" ON "public"."messages" USING GIST ("position")';
+
+END
+$migration$;
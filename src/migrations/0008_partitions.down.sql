@@ -0,0 +1,3 @@
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "partition_key";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "partitions";
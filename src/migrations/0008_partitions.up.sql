@@ -0,0 +1,3 @@
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "partitions" integer;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "partition_key" text;
@@ -0,0 +1,7 @@
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "overflow_policy";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "max_bytes";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "max_messages";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "max_lifetime";
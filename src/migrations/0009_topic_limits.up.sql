@@ -0,0 +1,8 @@
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "max_lifetime" integer;
+
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "max_messages" integer;
+
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "max_bytes" bigint;
+
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "overflow_policy" text
+    CHECK ("overflow_policy" IN ('reject', 'drop-oldest'));
@@ -0,0 +1,3 @@
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "schema";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "max_radius";
@@ -0,0 +1,3 @@
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "max_radius" integer;
+
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "schema" jsonb;
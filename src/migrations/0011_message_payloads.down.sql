@@ -0,0 +1,7 @@
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "data";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "body";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "headers";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "content_type";
@@ -0,0 +1,7 @@
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "content_type" text;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "headers" jsonb;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "body" jsonb;
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "data" bytea;
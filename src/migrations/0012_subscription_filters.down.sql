@@ -0,0 +1 @@
+ALTER TABLE "public"."subscriptions" DROP COLUMN IF EXISTS "filter";
@@ -0,0 +1 @@
+ALTER TABLE "public"."subscriptions" ADD COLUMN IF NOT EXISTS "filter" text;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS "public"."messages_search_idx";
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS "messages_search_idx" ON "public"."messages" USING GIN (to_tsvector('simple', COALESCE(title, '') || ' ' || COALESCE(payload, '')));
@@ -0,0 +1 @@
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "attachments" jsonb;
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS "public"."topic_keys";
+
+DROP TABLE IF EXISTS "public"."user_keys";
+
+ALTER TABLE "public"."messages" DROP COLUMN IF EXISTS "encryption";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "members";
+
+ALTER TABLE "public"."topics" DROP COLUMN IF EXISTS "private";
@@ -0,0 +1,22 @@
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "private" boolean DEFAULT false NOT NULL;
+
+ALTER TABLE "public"."topics" ADD COLUMN IF NOT EXISTS "members" text[];
+
+ALTER TABLE "public"."messages" ADD COLUMN IF NOT EXISTS "encryption" jsonb;
+
+CREATE TABLE IF NOT EXISTS "public"."user_keys" (
+    "email" text NOT NULL,
+    "public_key" bytea NOT NULL,
+    CONSTRAINT "user_keys_pk" PRIMARY KEY ("email"),
+    CONSTRAINT "user_keys_users_email_fk" FOREIGN KEY (email) REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE
+);
+
+CREATE TABLE IF NOT EXISTS "public"."topic_keys" (
+    "topic" text NOT NULL,
+    "version" integer NOT NULL,
+    "member" text NOT NULL,
+    "sealed_key" bytea NOT NULL,
+    "created_by" text NOT NULL,
+    CONSTRAINT "topic_keys_pk" PRIMARY KEY ("topic", "version", "member"),
+    CONSTRAINT "topic_keys_topics_name_fk" FOREIGN KEY (topic) REFERENCES topics(name) ON UPDATE CASCADE ON DELETE CASCADE NOT DEFERRABLE
+);
@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/twinj/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//MQTT control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+//MQTT protocol levels
+const (
+	mqttV311 = 4
+	mqttV5   = 5
+)
+
+var errMQTTMalformed = errors.New("mqtt: malformed packet")
+var errMQTTTooLarge = errors.New("mqtt: packet larger than maximum packet size")
+
+//Maximum size of packets read before CONNECT is accepted, mqtt-max-packet-size applies afterwards
+const mqttConnectMaxSize = 16 << 10
+
+//Accepted messages waiting to be written to a session, a session falling further behind misses the new ones
+const mqttOutboundQueue = 256
+
+//Delivery semantic associated to each MQTT QoS level
+var qosSemantics = map[byte]string{
+	0: "at-most-once",
+	1: "at-least-once",
+	2: "exactly-once",
+}
+
+type mqttServer struct {
+	r        *Receivers
+	listener net.Listener
+	sessions map[*mqttSession]bool
+	rm       sync.RWMutex
+}
+
+type mqttSession struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	version       byte
+	clientID      string
+	email         string
+	subscriptions map[string]bool //key: topic
+	wm            sync.Mutex      //serializing writes on connection
+	sm            sync.RWMutex    //protecting subscriptions
+
+	//messages are written in order by a single writer, woken by ready and stopped by closed
+	outbound []MessageData
+	retained map[string]map[string]bool //key: topic - value: ids of active messages queued on subscribe
+	qm       sync.Mutex                 //protecting outbound and retained
+	ready    chan struct{}
+	closed   chan struct{}
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+//Starting MQTT listener and registering it as EventBroker listener
+func (r *Receivers) initMQTT() {
+
+	listener, err := net.Listen("tcp", ":"+config().MQTTListeningPort)
+
+	if err != nil {
+		fatal("MQTT listener not started", err, "port", config().MQTTListeningPort)
+	}
+
+	ms := &mqttServer{
+		r:        r,
+		listener: listener,
+		sessions: map[*mqttSession]bool{},
+	}
+
+	r.mqtt = ms
+	r.eb.addListener(ms.dispatch)
+
+	slog.Info("MQTT listening", "port", config().MQTTListeningPort)
+
+	go ms.serve()
+}
+
+//Accepting connections until the listener is closed, backing off on errors as net/http does (5ms doubled up to 1s)
+func (ms *mqttServer) serve() {
+
+	var backoff time.Duration
+
+	for {
+
+		conn, err := ms.listener.Accept()
+
+		if err != nil {
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			backoff *= 2
+
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			}
+
+			if backoff > time.Second {
+				backoff = time.Second
+			}
+
+			slog.Error("MQTT connection not accepted", "error", err, "retry_in", backoff)
+
+			select {
+
+			case <-shutdownSignal:
+				return
+
+			case <-time.After(backoff):
+			}
+
+			continue
+		}
+
+		select {
+
+		//connections accepted while shutting down would not be closed by close()
+		case <-shutdownSignal:
+
+			_ = conn.Close()
+			return
+
+		default:
+		}
+
+		backoff = 0
+		go ms.handle(conn)
+	}
+}
+
+//Closing listener and client connections
+func (ms *mqttServer) close() {
+
+	_ = ms.listener.Close()
+
+	ms.rm.RLock()
+
+	for session := range ms.sessions {
+		_ = session.conn.Close()
+	}
+
+	ms.rm.RUnlock()
+}
+
+//Serving a single MQTT connection
+func (ms *mqttServer) handle(conn net.Conn) {
+
+	session := &mqttSession{
+		conn:          conn,
+		reader:        bufio.NewReader(conn),
+		subscriptions: map[string]bool{},
+		retained:      map[string]map[string]bool{},
+		ready:         make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+	}
+
+	defer func() {
+
+		ms.rm.Lock()
+		delete(ms.sessions, session)
+		ms.rm.Unlock()
+
+		close(session.closed)
+		_ = conn.Close()
+	}()
+
+	//first packet must be CONNECT
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	packet, err := session.readPacket(mqttConnectMaxSize)
+
+	if err != nil || packet.kind != mqttConnect {
+		return
+	}
+
+	keepAlive, ok := ms.connect(session, packet)
+
+	if !ok {
+		return
+	}
+
+	go session.deliver()
+
+	ms.rm.Lock()
+	ms.sessions[session] = true
+	ms.rm.Unlock()
+
+	for {
+
+		if keepAlive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			_ = conn.SetReadDeadline(time.Time{})
+		}
+
+		packet, err := session.readPacket(config().MQTTMaxPacketSize)
+
+		if err != nil {
+
+			//MQTT 5 clients are told why, they were sent the maximum in CONNACK
+			if errors.Is(err, errMQTTTooLarge) && session.version == mqttV5 {
+				_ = session.writePacket(mqttDisconnect<<4, []byte{0x95, 0})
+			}
+
+			if err != io.EOF {
+				session.logger().Info("MQTT connection closed", "error", err)
+			}
+
+			return
+		}
+
+		switch packet.kind {
+
+		case mqttPublish:
+			err = ms.publish(session, packet)
+
+		case mqttPubrel:
+			err = ms.release(session, packet)
+
+		case mqttSubscribe:
+			err = ms.subscribe(session, packet)
+
+		case mqttUnsubscribe:
+			err = ms.unsubscribe(session, packet)
+
+		case mqttPingreq:
+			err = session.writePacket(mqttPingresp<<4, nil)
+
+		case mqttPuback, mqttPubrec, mqttPubcomp:
+			//outbound messages are sent with QoS 0, nothing to acknowledge
+
+		case mqttDisconnect:
+			return
+
+		default:
+			err = errMQTTMalformed
+		}
+
+		if err != nil {
+			session.logger().Warn("MQTT client disconnected", "error", err)
+			return
+		}
+	}
+}
+
+//Authenticating client against users table and sending CONNACK
+func (ms *mqttServer) connect(session *mqttSession, packet mqttPacket) (time.Duration, bool) {
+
+	d := mqttDecoder{data: packet.body}
+
+	protocol := d.string()
+	session.version = d.byte()
+	flags := d.byte()
+	keepAlive := time.Second * time.Duration(d.uint16())
+
+	if d.err != nil || (protocol != "MQTT" && protocol != "MQIsdp") {
+		return 0, false
+	}
+
+	if session.version != mqttV311 && session.version != mqttV5 {
+
+		//answering with the lowest version code so that the client can understand it
+		session.version = mqttV311
+		_ = session.writePacket(mqttConnack<<4, []byte{0, 1})
+		return 0, false
+	}
+
+	d.properties(session.version)
+	session.clientID = d.string()
+
+	if session.clientID == "" {
+		session.clientID = uuid.NewV4().String()
+	}
+
+	//will message is not supported, skipping its fields
+	if flags&0x04 != 0 {
+		d.properties(session.version)
+		d.string()
+		d.binary()
+	}
+
+	var username, password string
+
+	if flags&0x80 != 0 {
+		username = d.string()
+	}
+
+	if flags&0x40 != 0 {
+		password = string(d.binary())
+	}
+
+	if d.err != nil {
+		return 0, false
+	}
+
+	if username == "" || !ms.r.dbServer.authenticate(username, password) {
+
+		code := byte(4)
+
+		if session.version == mqttV5 {
+			code = 0x86
+		}
+
+		_ = session.writeConnack(code)
+		return 0, false
+	}
+
+	session.email = username
+
+	return keepAlive, session.writeConnack(0) == nil
+}
+
+//Handling inbound PUBLISH, mapping QoS to delivery semantic
+func (ms *mqttServer) publish(session *mqttSession, packet mqttPacket) error {
+
+	qos := (packet.flags >> 1) & 0x03
+	d := mqttDecoder{data: packet.body}
+
+	topic := d.string()
+	var packetID uint16
+
+	if qos > 0 {
+		packetID = d.uint16()
+	}
+
+	d.properties(session.version)
+
+	if d.err != nil || qos > 2 {
+		return errMQTTMalformed
+	}
+
+	payload := d.data[d.pos:]
+
+	if !ms.r.eb.hasTopic(topic) {
+
+		if session.version == mqttV5 && qos > 0 {
+
+			//topic name invalid
+			return session.writeAck(qos, packetID, 0x90)
+		}
+
+		return errors.New("mqtt: unknown topic " + topic)
+	}
+
+	//sessions are authenticated, members publish on private topics like on /publish
+	if !ms.r.eb.canAccess(topic, session.email) {
+
+		if session.version == mqttV5 && qos > 0 {
+
+			//not authorized
+			return session.writeAck(qos, packetID, 0x87)
+		}
+
+		return errors.New("mqtt: not a member of private topic " + topic)
+	}
+
+	message := decodeMQTTPayload(topic, payload)
+
+	if message.Radius == 0 {
+
+		message.Radius = config().MQTTDefaultRadius
+
+		if maxRadius := ms.r.eb.limits(topic).maxRadius; maxRadius > 0 && message.Radius > maxRadius {
+			message.Radius = maxRadius
+		}
+	}
+
+	normalizePayload(&message)
+
+	//position, radius, lifetime, payload and key version are checked like on /publish
+	err := ms.r.eb.validateMessage(message)
+	rejected := err != nil
+
+	if err == nil {
+
+		err = ms.r.checkKeyVersion(context.Background(), message)
+		rejected = errors.Is(err, errUnknownKeyVersion)
+	}
+
+	if err != nil && !rejected {
+
+		session.logger().Error("MQTT publish not checked", "topic", topic, "error", err)
+
+		if session.version == mqttV5 && qos > 0 {
+
+			//unspecified error
+			return session.writeAck(qos, packetID, 0x80)
+		}
+
+		//without an acknowledgement the client will send the message again
+		return nil
+	}
+
+	if rejected {
+
+		session.logger().Info("MQTT publish rejected", "topic", topic, "reason", err)
+
+		if qos == 0 {
+			return nil
+		}
+
+		if session.version == mqttV5 {
+
+			//payload format invalid
+			return session.writeAck(qos, packetID, 0x99)
+		}
+
+		//sending the message again would not help, MQTT 3.1.1 has no negative acknowledgement
+		return session.writeAck(qos, packetID, 0)
+	}
+
+	switch qos {
+
+	case 0:
+		message.RequestID = uuid.NewV4().String()
+
+	case 2:
+		message.RequestID = session.requestID(packetID)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "MQTT PUBLISH "+topic, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int("messaging.mqtt.qos", int(qos)), attribute.String("messaging.client.id", session.clientID)))
+
+	var result PublishResult
+
+	//same user rate limits and daily quota as /publish, sessions have no token so the api-key limit does not apply
+	if limit, _ := exceededLimit(ctx, session.email, "", topic); limit != "" {
+
+		session.logger().Info("MQTT publish rejected", "topic", topic, "limit", limit)
+		result = PublishResult{Result: "rejected", Reason: limit + " exceeded"}
+
+	} else {
+
+		result = ms.r.routeMessage(ctx, message, qosSemantics[qos])
+	}
+
+	span.End()
+
+	if qos == 0 {
+		return nil
+	}
+
+	if result.Result == "rejected" {
+
+		if session.version == mqttV5 {
+
+			//quota exceeded
+			return session.writeAck(qos, packetID, 0x97)
+		}
+
+		//sending the message again would not help, MQTT 3.1.1 has no negative acknowledgement
+		return session.writeAck(qos, packetID, 0)
+	}
+
+	if result.Result != "success" {
+
+		if session.version == mqttV5 {
+
+			//unspecified error
+			return session.writeAck(qos, packetID, 0x80)
+		}
+
+		//without an acknowledgement the client will send the message again
+		return nil
+	}
+
+	return session.writeAck(qos, packetID, 0)
+}
+
+//Handling PUBREL of exactly-once flow, removing the request like /removeRequest
+func (ms *mqttServer) release(session *mqttSession, packet mqttPacket) error {
+
+	d := mqttDecoder{data: packet.body}
+	packetID := d.uint16()
+
+	if d.err != nil {
+		return errMQTTMalformed
+	}
+
+	ms.r.completeRequest(context.Background(), session.requestID(packetID))
+
+	return session.writeAck(mqttPubcomp, packetID, 0)
+}
+
+//Handling SUBSCRIBE, granting QoS 0 for existing topics
+func (ms *mqttServer) subscribe(session *mqttSession, packet mqttPacket) error {
+
+	d := mqttDecoder{data: packet.body}
+	packetID := d.uint16()
+	d.properties(session.version)
+
+	var codes []byte
+	var topics []string
+
+	for d.err == nil && d.pos < len(d.data) {
+
+		topic := d.string()
+		d.byte()
+
+		if ms.r.eb.hasTopic(topic) && ms.r.eb.canAccess(topic, session.email) {
+
+			codes = append(codes, 0)
+			topics = append(topics, topic)
+
+		} else if session.version == mqttV5 && ms.r.eb.hasTopic(topic) {
+
+			//not authorized
+			codes = append(codes, 0x87)
+
+		} else if session.version == mqttV5 {
+
+			//topic filter invalid
+			codes = append(codes, 0x8F)
+
+		} else {
+
+			codes = append(codes, 0x80)
+		}
+	}
+
+	if d.err != nil || len(codes) == 0 {
+		return errMQTTMalformed
+	}
+
+	err := session.writePacket(mqttSuback<<4, session.withProperties(packetID, codes))
+
+	if err != nil {
+		return err
+	}
+
+	//queueing active messages, they act like retained messages, before dispatch can queue newer ones of the topics
+	session.sm.Lock()
+	defer session.sm.Unlock()
+
+	for _, topic := range topics {
+
+		session.subscriptions[topic] = true
+		session.queueRetained(topic, ms.r.eb.activeMessages(topic))
+	}
+
+	return nil
+}
+
+//Handling UNSUBSCRIBE
+func (ms *mqttServer) unsubscribe(session *mqttSession, packet mqttPacket) error {
+
+	d := mqttDecoder{data: packet.body}
+	packetID := d.uint16()
+	d.properties(session.version)
+
+	var codes []byte
+
+	session.sm.Lock()
+
+	for d.err == nil && d.pos < len(d.data) {
+
+		topic := d.string()
+		delete(session.subscriptions, topic)
+		session.forgetRetained(topic)
+		codes = append(codes, 0)
+	}
+
+	session.sm.Unlock()
+
+	if d.err != nil {
+		return errMQTTMalformed
+	}
+
+	if session.version != mqttV5 {
+		codes = nil
+	}
+
+	return session.writePacket(mqttUnsuback<<4, session.withProperties(packetID, codes))
+}
+
+//Queueing accepted message for every session subscribed to its topic that can still access it: a topic may become
+//private, or its members change, after sessions subscribed. Sessions whose queue is full miss the message
+func (ms *mqttServer) dispatch(message MessageData) {
+
+	ms.rm.RLock()
+	defer ms.rm.RUnlock()
+
+	for session := range ms.sessions {
+
+		session.sm.RLock()
+
+		if session.subscriptions[message.Topic] && ms.r.eb.canAccess(message.Topic, session.email) {
+
+			if !session.queueMessage(message) {
+				session.logger().Warn("MQTT delivery dropped, session too slow", "topic", message.Topic,
+					"message_id", message.ID)
+			}
+		}
+
+		session.sm.RUnlock()
+	}
+}
+
+//Queueing active messages of topic on subscribe. A message stored just before may still be dispatched afterwards, its
+//id is kept until then so that it is not sent twice
+func (s *mqttSession) queueRetained(topic string, messages MessageDataSlice) {
+
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	ids := make(map[string]bool, len(messages))
+
+	for _, message := range messages {
+		ids[message.ID] = true
+	}
+
+	s.retained[topic] = ids
+	s.outbound = append(s.outbound, messages...)
+	s.wake()
+}
+
+//Queueing a dispatched message, refused if the queue is full. Messages already queued on subscribe are skipped
+func (s *mqttSession) queueMessage(message MessageData) bool {
+
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	if s.retained[message.Topic][message.ID] {
+
+		delete(s.retained[message.Topic], message.ID)
+		return true
+	}
+
+	if len(s.outbound) >= mqttOutboundQueue {
+		return false
+	}
+
+	s.outbound = append(s.outbound, message)
+	s.wake()
+
+	return true
+}
+
+func (s *mqttSession) forgetRetained(topic string) {
+
+	s.qm.Lock()
+	delete(s.retained, topic)
+	s.qm.Unlock()
+}
+
+//Waking the writer, which may already have been woken. Caller holds s.qm
+func (s *mqttSession) wake() {
+
+	select {
+
+	case s.ready <- struct{}{}:
+
+	default:
+	}
+}
+
+//Getting next queued message
+func (s *mqttSession) next() (MessageData, bool) {
+
+	s.qm.Lock()
+	defer s.qm.Unlock()
+
+	if len(s.outbound) == 0 {
+
+		s.outbound = nil
+		return MessageData{}, false
+	}
+
+	message := s.outbound[0]
+	s.outbound = s.outbound[1:]
+
+	return message, true
+}
+
+//Writing queued messages in order until the session ends, a failed write closes the connection
+func (s *mqttSession) deliver() {
+
+	for {
+
+		select {
+
+		case <-s.closed:
+			return
+
+		case <-s.ready:
+		}
+
+		for message, ok := s.next(); ok; message, ok = s.next() {
+
+			_, span := startDeliverySpan(message, "MQTT deliver", attribute.String("messaging.client.id", s.clientID))
+			err := s.writeMessage(message)
+			endSpan(span, err)
+
+			if err != nil {
+
+				s.logger().Warn("MQTT delivery failed", "topic", message.Topic, "error", err)
+				_ = s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+//Building message from MQTT payload, plain text payloads become message body and other payloads binary data
+func decodeMQTTPayload(topic string, payload []byte) MessageData {
+
+	var message MessageData
+	err := json.Unmarshal(payload, &message)
+
+	if err != nil {
+
+		message = MessageData{
+			Message:  string(payload),
+			LifeTime: config().MQTTDefaultLifetime,
+		}
+
+		if !utf8.Valid(payload) {
+			message.Message, message.Data = "", append([]byte(nil), payload...)
+		}
+	}
+
+	if message.LifeTime == 0 {
+		message.LifeTime = config().MQTTDefaultLifetime
+	}
+
+	message.Topic = topic
+
+	return message
+}
+
+//Getting request id of an exactly-once publish. Client ids are chosen by clients, so the user is part of it: a client
+//cannot complete or suppress requests of another user reusing its client id
+func (s *mqttSession) requestID(packetID uint16) string {
+
+	return s.email + "/" + s.clientID + "/" + strconv.Itoa(int(packetID))
+}
+
+//Getting logger with session fields
+func (s *mqttSession) logger() *slog.Logger {
+
+	return slog.With("mqtt_client", s.clientID, "user", s.email)
+}
+
+//Reading a whole control packet of at most limit bytes, fixed header included, larger packets are not read
+func (s *mqttSession) readPacket(limit int) (mqttPacket, error) {
+
+	header, err := s.reader.ReadByte()
+
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length := 0
+
+	for i := 0; ; i++ {
+
+		b, err := s.reader.ReadByte()
+
+		if err != nil {
+			return mqttPacket{}, err
+		}
+
+		length |= int(b&0x7F) << (7 * i)
+
+		if b&0x80 == 0 {
+			break
+		}
+
+		if i == 3 {
+			return mqttPacket{}, errMQTTMalformed
+		}
+	}
+
+	//header byte and remaining length bytes
+	if 1+lengthSize(length)+length > limit {
+		return mqttPacket{}, errMQTTTooLarge
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(s.reader, body)
+
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	return mqttPacket{kind: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+//Writing a control packet with given fixed header
+func (s *mqttSession) writePacket(header byte, body []byte) error {
+
+	packet := []byte{header}
+	length := len(body)
+
+	for {
+
+		b := byte(length & 0x7F)
+		length >>= 7
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	packet = append(packet, body...)
+
+	s.wm.Lock()
+	defer s.wm.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	_, err := s.conn.Write(packet)
+
+	return err
+}
+
+func (s *mqttSession) writeConnack(code byte) error {
+
+	body := []byte{0, code}
+
+	//properties: maximum packet size the server accepts
+	if s.version == mqttV5 {
+
+		body = append(body, 5, 0x27)
+		body = binary.BigEndian.AppendUint32(body, uint32(config().MQTTMaxPacketSize))
+	}
+
+	return s.writePacket(mqttConnack<<4, body)
+}
+
+//Getting bytes taken by remaining length in the fixed header
+func lengthSize(length int) int {
+
+	size := 1
+
+	for ; length >= 128; length >>= 7 {
+		size++
+	}
+
+	return size
+}
+
+//Writing PUBACK, PUBREC or PUBCOMP for given QoS or packet type
+func (s *mqttSession) writeAck(kind byte, packetID uint16, code byte) error {
+
+	switch kind {
+
+	case 1:
+		kind = mqttPuback
+
+	case 2:
+		kind = mqttPubrec
+	}
+
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, packetID)
+
+	if s.version == mqttV5 && code != 0 {
+		body = append(body, code)
+	}
+
+	return s.writePacket(kind<<4, body)
+}
+
+//Sending message as JSON payload with QoS 0
+func (s *mqttSession) writeMessage(message MessageData) error {
+
+	payload, err := json.Marshal(message)
+
+	if err != nil {
+		return err
+	}
+
+	body := appendMQTTString(nil, message.Topic)
+
+	if s.version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	return s.writePacket(mqttPublish<<4, append(body, payload...))
+}
+
+//Building variable header with packet id, properties (v5 only) and reason codes
+func (s *mqttSession) withProperties(packetID uint16, codes []byte) []byte {
+
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, packetID)
+
+	if s.version == mqttV5 {
+		body = append(body, 0)
+	}
+
+	return append(body, codes...)
+}
+
+func appendMQTTString(b []byte, value string) []byte {
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(value)))
+
+	return append(append(b, length...), value...)
+}
+
+//Sequential reader of packet fields, keeping the first error
+type mqttDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *mqttDecoder) byte() byte {
+
+	if d.err != nil || d.pos+1 > len(d.data) {
+		d.err = errMQTTMalformed
+		return 0
+	}
+
+	d.pos++
+
+	return d.data[d.pos-1]
+}
+
+func (d *mqttDecoder) uint16() uint16 {
+
+	if d.err != nil || d.pos+2 > len(d.data) {
+		d.err = errMQTTMalformed
+		return 0
+	}
+
+	d.pos += 2
+
+	return binary.BigEndian.Uint16(d.data[d.pos-2:])
+}
+
+func (d *mqttDecoder) binary() []byte {
+
+	length := int(d.uint16())
+
+	if d.err != nil || d.pos+length > len(d.data) {
+		d.err = errMQTTMalformed
+		return nil
+	}
+
+	d.pos += length
+
+	return d.data[d.pos-length : d.pos]
+}
+
+func (d *mqttDecoder) string() string {
+
+	return string(d.binary())
+}
+
+//Skipping MQTT 5 properties, they are not used by the broker
+func (d *mqttDecoder) properties(version byte) {
+
+	if version != mqttV5 {
+		return
+	}
+
+	length := 0
+
+	for i := 0; i < 4; i++ {
+
+		b := d.byte()
+		length |= int(b&0x7F) << (7 * i)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if d.err != nil || d.pos+length > len(d.data) {
+		d.err = errMQTTMalformed
+		return
+	}
+
+	d.pos += length
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//Messages of a topic are spread over partitions by partition key. Every partition has its own lock and keeps its messages in
+//offset order, so that publishers of different partitions do not wait for each other; offsets are still assigned per topic
+type partition struct {
+	messages MessageDataSlice //active messages
+	log      MessageDataSlice //messages ordered by offset, kept for replay
+	index    *searchIndex     //index of the topic, nil when search is served by Postgres
+	rm       sync.RWMutex
+}
+
+type topicQueue struct {
+	offset     atomic.Int64 //last assigned offset
+	count      atomic.Int64 //active messages of all partitions, checked against max-messages
+	bytes      atomic.Int64 //size of active messages of all partitions, checked against max-bytes
+	partitions []*partition
+	index      *searchIndex //words of active messages of all partitions
+	rm         sync.RWMutex //held for writing only while partitions are resized
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+//Encoding position as a geohash of precision characters, nearby positions share a prefix
+func geohash(latitude float64, longitude float64, precision int) string {
+
+	latitudeRange := [2]float64{-90, 90}
+	longitudeRange := [2]float64{-180, 180}
+
+	var hash strings.Builder
+	bits, char, even := 0, 0, true
+
+	for hash.Len() < precision {
+
+		interval, value := &longitudeRange, longitude
+
+		if !even {
+			interval, value = &latitudeRange, latitude
+		}
+
+		middle := (interval[0] + interval[1]) / 2
+		char <<= 1
+
+		if value >= middle {
+
+			char |= 1
+			interval[0] = middle
+
+		} else {
+
+			interval[1] = middle
+		}
+
+		even = !even
+
+		if bits++; bits == 5 {
+
+			hash.WriteByte(geohashAlphabet[char])
+			bits, char = 0, 0
+		}
+	}
+
+	return hash.String()
+}
+
+//Getting the key choosing the partition of message: the producer key, or the geohash of the message position
+func partitionKey(message *MessageData) string {
+
+	if message.PartitionKey != "" {
+		return message.PartitionKey
+	}
+
+	return geohash(message.Latitude, message.Longitude, config().PartitionPrecision)
+}
+
+func partitionIndex(key string, partitions int) int {
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+
+	return int(hash.Sum32() % uint32(partitions))
+}
+
+func newPartitions(count int, index *searchIndex) []*partition {
+
+	partitions := make([]*partition, count)
+
+	for i := range partitions {
+		partitions[i] = &partition{index: index}
+	}
+
+	return partitions
+}
+
+//Getting the number of partitions of topic
+func (eb *EventBroker) partitionCount(topic string) int {
+
+	eb.rm.RLock()
+	partitions := eb.definitions[topic].Partitions
+	eb.rm.RUnlock()
+
+	if partitions == nil {
+		return config().TopicPartitions
+	}
+
+	return *partitions
+}
+
+//Getting queue of topic, nil if no message has been published on it yet
+func (eb *EventBroker) findQueue(topic string) *topicQueue {
+
+	eb.queuesLock.RLock()
+	defer eb.queuesLock.RUnlock()
+
+	return eb.queues[topic]
+}
+
+//Getting queue of topic, creating it if needed
+func (eb *EventBroker) queue(topic string) *topicQueue {
+
+	if q := eb.findQueue(topic); q != nil {
+		return q
+	}
+
+	count := eb.partitionCount(topic)
+
+	eb.queuesLock.Lock()
+	defer eb.queuesLock.Unlock()
+
+	q, found := eb.queues[topic]
+
+	if !found {
+
+		index := newSearchIndex()
+		q = &topicQueue{partitions: newPartitions(count, index), index: index}
+		eb.queues[topic] = q
+	}
+
+	return q
+}
+
+//Getting a copy of the queues map
+func (eb *EventBroker) topicQueues() map[string]*topicQueue {
+
+	eb.queuesLock.RLock()
+	defer eb.queuesLock.RUnlock()
+
+	queues := make(map[string]*topicQueue, len(eb.queues))
+
+	for topic, q := range eb.queues {
+		queues[topic] = q
+	}
+
+	return queues
+}
+
+//Getting partition of message, setting message.Partition. Caller holds q.rm
+func (q *topicQueue) partitionOf(message *MessageData) *partition {
+
+	message.Partition = partitionIndex(partitionKey(message), len(q.partitions))
+
+	return q.partitions[message.Partition]
+}
+
+//Raising last assigned offset to offset of a message assigned elsewhere
+func (q *topicQueue) advance(offset int64) {
+
+	for {
+
+		last := q.offset.Load()
+
+		if offset <= last || q.offset.CompareAndSwap(last, offset) {
+			return
+		}
+	}
+}
+
+//Getting last assigned offset of topic
+func (eb *EventBroker) lastOffset(topic string) int64 {
+
+	if q := eb.findQueue(topic); q != nil {
+		return q.offset.Load()
+	}
+
+	return 0
+}
+
+//Collecting messages of all partitions ordered by offset
+func (q *topicQueue) collect(messages func(p *partition) MessageDataSlice) MessageDataSlice {
+
+	result := MessageDataSlice{}
+
+	if q == nil {
+		return result
+	}
+
+	q.rm.RLock()
+
+	for _, p := range q.partitions {
+
+		p.rm.RLock()
+		result = append(result, messages(p)...)
+		p.rm.RUnlock()
+	}
+
+	q.rm.RUnlock()
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Offset < result[j].Offset
+	})
+
+	return result
+}
+
+//Getting a copy of active messages of topic ordered by offset
+func (eb *EventBroker) activeMessages(topic string) MessageDataSlice {
+
+	return eb.findQueue(topic).collect(func(p *partition) MessageDataSlice { return p.messages })
+}
+
+//Getting a copy of replay log of topic ordered by offset
+func (eb *EventBroker) logMessages(topic string) MessageDataSlice {
+
+	return eb.findQueue(topic).collect(func(p *partition) MessageDataSlice { return p.log })
+}
+
+//Counting active messages of all partitions
+func (q *topicQueue) depth() int {
+
+	q.rm.RLock()
+	defer q.rm.RUnlock()
+
+	depth := 0
+
+	for _, p := range q.partitions {
+
+		p.rm.RLock()
+		depth += len(p.messages)
+		p.rm.RUnlock()
+	}
+
+	return depth
+}
+
+//Appending message to active messages and to the search index, the caller counts it in the topic totals. Caller holds p.rm
+func (p *partition) enqueue(message MessageData) {
+
+	p.messages = append(p.messages, message)
+	p.index.add(message)
+}
+
+//Changing active messages and bytes of the topic totals
+func (q *topicQueue) account(messages int64, bytes int64) {
+
+	q.count.Add(messages)
+	q.bytes.Add(bytes)
+}
+
+//Checking if message is in replay log of partition, newest messages first. Caller holds p.rm
+func (p *partition) logged(id string) bool {
+
+	for i := len(p.log) - 1; i >= 0; i-- {
+
+		if p.log[i].ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Inserting message into replay log keeping it ordered by offset, messages may arrive out of order. Caller holds p.rm
+func (p *partition) insertLog(message MessageData) {
+
+	position := len(p.log)
+
+	for position > 0 && p.log[position-1].Offset > message.Offset {
+		position--
+	}
+
+	p.log = append(p.log, MessageData{})
+	copy(p.log[position+1:], p.log[position:])
+	p.log[position] = message
+}
+
+//Removing messages matching remove from active messages of every partition, keeping their order
+func (q *topicQueue) removeMessages(remove func(message MessageData) bool) MessageDataSlice {
+
+	var removed MessageDataSlice
+
+	q.rm.RLock()
+
+	for _, p := range q.partitions {
+
+		p.rm.Lock()
+
+		kept := p.messages[:0]
+
+		for _, message := range p.messages {
+
+			if remove(message) {
+
+				removed = append(removed, message)
+				q.account(-1, -messageSize(message))
+
+			} else {
+
+				kept = append(kept, message)
+			}
+		}
+
+		p.messages = kept
+		p.rm.Unlock()
+	}
+
+	q.rm.RUnlock()
+	q.index.remove(removed...)
+
+	return removed
+}
+
+//Removing messages matching remove from replay log of every partition
+func (q *topicQueue) removeLog(remove func(message MessageData) bool) {
+
+	q.rm.RLock()
+
+	for _, p := range q.partitions {
+
+		p.rm.Lock()
+
+		kept := p.log[:0]
+
+		for _, message := range p.log {
+
+			if !remove(message) {
+				kept = append(kept, message)
+			}
+		}
+
+		p.log = kept
+		p.rm.Unlock()
+	}
+
+	q.rm.RUnlock()
+}
+
+//Moving messages of topic to the partitions given by its partition count, after the count changed
+func (eb *EventBroker) resizeTopic(topic string) {
+
+	q := eb.findQueue(topic)
+
+	if q == nil {
+		return
+	}
+
+	count := eb.partitionCount(topic)
+
+	q.rm.Lock()
+	defer q.rm.Unlock()
+
+	if len(q.partitions) == count {
+		return
+	}
+
+	var messages, log MessageDataSlice
+
+	for _, p := range q.partitions {
+
+		messages = append(messages, p.messages...)
+		log = append(log, p.log...)
+	}
+
+	q.partitions = newPartitions(count, q.index)
+
+	sort.SliceStable(log, func(i, j int) bool {
+		return log[i].Offset < log[j].Offset
+	})
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Offset < messages[j].Offset
+	})
+
+	for i := range log {
+
+		p := q.partitionOf(&log[i])
+		p.log = append(p.log, log[i])
+	}
+
+	for i := range messages {
+
+		q.partitionOf(&messages[i]).enqueue(messages[i])
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+//Content types of messages published without one, by payload field
+const (
+	contentTypeText   = "text/plain; charset=utf-8" //Message
+	contentTypeJSON   = "application/json"          //Body
+	contentTypeBinary = "application/octet-stream"  //Data
+)
+
+//Checking payload fields of a message sent by a client: one of Message, Body and Data, a valid content type and named headers
+func validatePayloadFields(message MessageData) error {
+
+	var errs []error
+	payloads := 0
+
+	for _, present := range []bool{message.Message != "", len(message.Body) > 0, len(message.Data) > 0} {
+
+		if present {
+			payloads++
+		}
+	}
+
+	if payloads > 1 {
+		errs = append(errs, errors.New("only one of Message, Body and Data can be set"))
+	}
+
+	if message.ContentType != "" {
+
+		mediaType, _, err := mime.ParseMediaType(message.ContentType)
+
+		if err == nil && !strings.Contains(mediaType, "/") {
+			err = errors.New("expected type/subtype")
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("content type not valid: %w", err))
+		}
+	}
+
+	for name := range message.Headers {
+
+		if name == "" || !utf8.ValidString(name) {
+			errs = append(errs, errors.New("header names must be non-empty UTF-8 text"))
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+//Dropping a null Body and setting content type of message from its payload field when the producer gave none. Encrypted
+//messages get none, their content type is inside the ciphertext
+func normalizePayload(message *MessageData) {
+
+	if string(message.Body) == "null" {
+		message.Body = nil
+	}
+
+	if message.ContentType != "" || message.Encryption != nil {
+		return
+	}
+
+	switch {
+
+	case len(message.Body) > 0:
+		message.ContentType = contentTypeJSON
+
+	case len(message.Data) > 0:
+		message.ContentType = contentTypeBinary
+
+	default:
+		message.ContentType = contentTypeText
+	}
+}
+
+//Getting the JSON document checked against the schema of the topic: Body, or Message for producers sending JSON as text
+func payloadDocument(message MessageData) (json.RawMessage, error) {
+
+	if len(message.Body) > 0 {
+		return message.Body, nil
+	}
+
+	if len(message.Data) > 0 {
+		return nil, errors.New("binary payload on a topic with schema")
+	}
+
+	return json.RawMessage(message.Message), nil
+}
+
+//Bytes of headers counted by max-bytes
+func headersSize(headers map[string]string) int {
+
+	size := 0
+
+	for name, value := range headers {
+		size += len(name) + len(value)
+	}
+
+	return size
+}
@@ -3,49 +3,32 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 )
 
 type server struct {
 	db *sql.DB
 }
 
-//localhost configuration
-const (
-	host     = "172.28.1.3"
-	port     = 5432
-	user     = "postgres"
-	password = "password"
-	dbname   = "sdcc"
-)
-
-//RDS deployment configuration
-/*const (
-	host     = "sdcc-db.c6fwapw2bm2k.us-east-1.rds.amazonaws.com"
-	port     = 5432
-	user     = "postgres"
-	password = "ElAmqMhwe82DonytfC1a"
-	dbname   = "postgres"
-)*/
-
 func initDB() (s *server, database *sql.DB) {
 
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+		"password=%s dbname=%s sslmode=%s",
+		config().PostgresHost, config().PostgresPort, config().PostgresUser, config().PostgresPassword, config().PostgresDatabase,
+		config().PostgresSSLMode)
 	db, err := sql.Open("postgres", psqlInfo)
 
 	if err != nil {
-		log.Panic(err)
+		fatal("invalid Postgres configuration", err)
 	}
 
-	err = db.Ping()
+	err = retryOnStartup("Postgres", db.Ping)
 
 	if err != nil {
-		log.Panic(err)
+		fatal("Postgres not available", err)
 	}
 
-	log.Println("Successfully connected!")
+	slog.Info("connected to Postgres", "host", config().PostgresHost, "database", config().PostgresDatabase)
 
 	return &server{db: db}, db
 }
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//State change operations replicated by Raft
+const (
+	changeDefineTopic   = "define-topic"
+	changeSubscribe     = "subscribe"
+	changeUnsubscribe   = "unsubscribe"
+	changeStoreRequest  = "store-request"
+	changeDeleteRequest = "delete-request"
+)
+
+//A change to topics, subscriptions or requests, applied in the same order on every node
+type StateChange struct {
+	Op         string            `json:"Op"`
+	Topic      string            `json:"Topic,omitempty"`
+	Definition *TopicDefinition  `json:"Definition,omitempty"`
+	Subscriber string            `json:"Subscriber,omitempty"`
+	Filter     string            `json:"Filter,omitempty"` //filter of the subscription, replaced on every subscribe
+	Request    *PublishedRequest `json:"Request,omitempty"`
+	RequestID  string            `json:"RequestID,omitempty"`
+}
+
+//State saved in Raft snapshots
+type BrokerState struct {
+	Topics        Topics                       `json:"Topics"`
+	Definitions   map[string]TopicDefinition   `json:"Definitions"`
+	Subscriptions map[string]Topics            `json:"Subscriptions"`
+	Filters       map[string]map[string]string `json:"Filters"` //key: user - value: filter expressions by topic
+	Requests      map[string]PublishedRequest  `json:"Requests"`
+}
+
+//Raft group member, the server id of a node is its cluster-advertise-url so that followers know where to forward writes
+type raftNode struct {
+	raft    *raft.Raft
+	forward func(ctx context.Context, leader raft.ServerID, change StateChange) error
+}
+
+var errNoLeader = errors.New("raft leader not elected")
+
+//Parsing raft-peers: comma separated <node url>=<raft address>
+func raftPeers(peers string) (map[raft.ServerID]raft.ServerAddress, error) {
+
+	servers := map[raft.ServerID]raft.ServerAddress{}
+
+	for _, peer := range strings.Split(peers, ",") {
+
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+
+		parts := strings.SplitN(peer, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid raft peer %q", peer)
+		}
+
+		servers[raft.ServerID(strings.TrimSuffix(parts[0], "/"))] = raft.ServerAddress(parts[1])
+	}
+
+	return servers, nil
+}
+
+//Settings shared by nodes of the broker and of the test harness
+func raftConfig(id raft.ServerID) *raft.Config {
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = id
+	conf.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Output:     logWriter,
+		Level:      hclog.Warn,
+		JSONFormat: config().LogFormat == "json",
+	})
+
+	return conf
+}
+
+//Joining the Raft group replicating topics, subscriptions and requests, state is kept in raft-data-dir
+func (r *Receivers) initRaft() {
+
+	if !config().RaftEnabled {
+		return
+	}
+
+	dir := config().RaftDataDir
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		fatal("raft data directory not created", err, "dir", dir)
+	}
+
+	advertise := config().RaftAdvertiseAddress
+
+	if advertise == "" {
+		advertise = config().RaftBindAddress
+	}
+
+	address, err := net.ResolveTCPAddr("tcp", advertise)
+
+	if err != nil {
+		fatal("raft advertise address not resolved", err, "address", advertise)
+	}
+
+	transport, err := raft.NewTCPTransport(config().RaftBindAddress, address, 3, 10*time.Second, logWriter)
+
+	if err != nil {
+		fatal("raft transport not started", err, "address", config().RaftBindAddress)
+	}
+
+	store, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(dir, "raft.db")})
+
+	if err != nil {
+		fatal("raft log not opened", err, "dir", dir)
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, logWriter)
+
+	if err != nil {
+		fatal("raft snapshots not opened", err, "dir", dir)
+	}
+
+	id := raft.ServerID(r.cluster.self)
+	node, err := r.newRaftNode(raftConfig(id), store, store, snapshots, transport)
+
+	if err != nil {
+		fatal("raft not started", err)
+	}
+
+	existing, err := raft.HasExistingState(store, store, snapshots)
+
+	if err != nil {
+		fatal("raft state not read", err)
+	}
+
+	if config().RaftBootstrap && !existing {
+
+		peers, _ := raftPeers(config().RaftPeers)
+		peers[id] = transport.LocalAddr()
+
+		var servers []raft.Server
+
+		for peer, peerAddress := range peers {
+			servers = append(servers, raft.Server{ID: peer, Address: peerAddress})
+		}
+
+		if err = node.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			fatal("raft cluster not bootstrapped", err)
+		}
+
+		slog.Info("raft cluster bootstrapped", "servers", len(servers))
+	}
+
+	node.forward = func(ctx context.Context, leader raft.ServerID, change StateChange) error {
+		return r.cluster.call(ctx, http.MethodPost, string(leader), "/internal/raft/apply", change, nil)
+	}
+
+	r.raft = node
+
+	slog.Info("raft started", "id", id, "address", transport.LocalAddr())
+}
+
+func (r *Receivers) newRaftNode(conf *raft.Config, logs raft.LogStore, stable raft.StableStore, snapshots raft.SnapshotStore,
+	transport raft.Transport) (*raftNode, error) {
+
+	group, err := raft.NewRaft(conf, &brokerFSM{r}, logs, stable, snapshots, transport)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &raftNode{raft: group}, nil
+}
+
+//Committing change through the leader, forwarding it when this node is a follower
+func (n *raftNode) apply(ctx context.Context, change StateChange) error {
+
+	data, err := json.Marshal(change)
+
+	if err != nil {
+		return err
+	}
+
+	if n.raft.State() == raft.Leader {
+
+		future := n.raft.Apply(data, time.Millisecond*time.Duration(config().RaftApplyTimeout))
+
+		if err = future.Error(); err == nil {
+
+			if applyErr, ok := future.Response().(error); ok {
+				return applyErr
+			}
+
+			return nil
+		}
+
+		//leadership lost meanwhile, the new leader is asked below
+		if !errors.Is(err, raft.ErrNotLeader) && !errors.Is(err, raft.ErrLeadershipLost) {
+			return err
+		}
+	}
+
+	_, leader := n.raft.LeaderWithID()
+
+	if leader == "" {
+		return errNoLeader
+	}
+
+	return n.forward(ctx, leader, change)
+}
+
+//Getting current term, used by topic owners to fence messages of deposed ones
+func (n *raftNode) term() uint64 {
+
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+
+	return term
+}
+
+func (n *raftNode) shutdown() {
+
+	if err := n.raft.Shutdown().Error(); err != nil {
+		slog.Error("raft not stopped", "error", err)
+	}
+}
+
+//Applying change through Raft when enabled, otherwise locally and on the other nodes with a cluster event
+func (r *Receivers) applyChange(ctx context.Context, change StateChange) error {
+
+	if r.raft != nil {
+		return r.raft.apply(ctx, change)
+	}
+
+	r.applyLocal(change)
+
+	switch change.Op {
+
+	case changeDefineTopic:
+		r.cluster.broadcast(ClusterEvent{Type: eventTopics})
+
+	case changeSubscribe, changeUnsubscribe:
+		r.cluster.broadcast(ClusterEvent{Type: eventSubscriptions, Subscriber: change.Subscriber})
+
+	case changeDeleteRequest:
+		r.cluster.broadcast(ClusterEvent{Type: eventRemoveRequest, RequestID: change.RequestID})
+	}
+
+	return nil
+}
+
+//Changing EventBroker state, changes are idempotent since Raft may apply a log entry again after a restore
+func (r *Receivers) applyLocal(change StateChange) {
+
+	switch change.Op {
+
+	case changeDefineTopic:
+		if change.Definition != nil {
+			r.eb.defineTopic(*change.Definition)
+		}
+
+	case changeSubscribe:
+
+		r.eb.rm.RLock()
+		subscribed := stringInSlice(change.Topic, r.eb.userTopics[change.Subscriber])
+		r.eb.rm.RUnlock()
+
+		if !subscribed {
+			r.topicSubscription(change.Topic, change.Subscriber)
+		}
+
+		r.eb.setFilter(change.Subscriber, change.Topic, change.Filter)
+
+	case changeUnsubscribe:
+		r.topicUnsubscription(change.Subscriber, change.Topic)
+
+	case changeStoreRequest:
+
+		if change.Request != nil {
+			r.eb.storeRequest(*change.Request)
+		}
+
+	case changeDeleteRequest:
+		r.eb.deleteRequest(change.RequestID)
+	}
+}
+
+//Copying replicated state of EventBroker
+func (eb *EventBroker) state() BrokerState {
+
+	state := BrokerState{
+		Definitions:   map[string]TopicDefinition{},
+		Subscriptions: map[string]Topics{},
+		Filters:       map[string]map[string]string{},
+		Requests:      map[string]PublishedRequest{},
+	}
+
+	eb.rm.RLock()
+
+	state.Topics = append(Topics{}, eb.topics...)
+
+	for topic, definition := range eb.definitions {
+		state.Definitions[topic] = definition
+	}
+
+	for user, topics := range eb.userTopics {
+		state.Subscriptions[user] = append(Topics{}, topics...)
+	}
+
+	for user, filters := range eb.filters {
+
+		if len(filters) == 0 {
+			continue
+		}
+
+		state.Filters[user] = map[string]string{}
+
+		for topic, filter := range filters {
+			state.Filters[user][topic] = filter.expression
+		}
+	}
+
+	eb.rm.RUnlock()
+
+	eb.requestsLock.Lock()
+
+	for requestID, request := range eb.requests {
+		state.Requests[requestID] = request
+	}
+
+	eb.requestsLock.Unlock()
+
+	return state
+}
+
+//Raft state machine over EventBroker
+type brokerFSM struct {
+	r *Receivers
+}
+
+func (f *brokerFSM) Apply(entry *raft.Log) interface{} {
+
+	var change StateChange
+
+	if err := json.Unmarshal(entry.Data, &change); err != nil {
+		return err
+	}
+
+	f.r.applyLocal(change)
+
+	return nil
+}
+
+func (f *brokerFSM) Snapshot() (raft.FSMSnapshot, error) {
+
+	return &brokerSnapshot{f.r.eb.state()}, nil
+}
+
+//Replacing replicated state with the one of a snapshot
+func (f *brokerFSM) Restore(snapshot io.ReadCloser) error {
+
+	defer snapshot.Close()
+
+	var state BrokerState
+
+	if err := json.NewDecoder(snapshot).Decode(&state); err != nil {
+		return err
+	}
+
+	eb := f.r.eb
+
+	eb.rm.Lock()
+	eb.topics = state.Topics
+	eb.definitions = state.Definitions
+	eb.userTopics = state.Subscriptions
+	eb.filters = map[string]topicFilters{}
+	eb.rm.Unlock()
+
+	for user, expressions := range state.Filters {
+		eb.replaceFilters(user, expressions)
+	}
+
+	for topic := range eb.topicQueues() {
+		eb.resizeTopic(topic)
+	}
+
+	eb.requestsLock.Lock()
+	eb.requests = state.Requests
+	eb.requestsLock.Unlock()
+
+	return nil
+}
+
+type brokerSnapshot struct {
+	state BrokerState
+}
+
+func (s *brokerSnapshot) Persist(sink raft.SnapshotSink) error {
+
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+
+		_ = sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *brokerSnapshot) Release() {}
+
+//Committing a change forwarded by a follower
+func (r *Receivers) internalRaftApply(c *gin.Context) {
+
+	var change StateChange
+	err := json.NewDecoder(c.Request.Body).Decode(&change)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.raft == nil {
+
+		c.JSON(http.StatusBadRequest, "Raft not enabled")
+		return
+	}
+
+	withLogFields(c, "raft_op", change.Op)
+
+	if err = r.raft.apply(c.Request.Context(), change); err != nil {
+		failRequest(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, "ok")
+}
+
+//Getting Raft state of this node
+func (r *Receivers) raftStatus(c *gin.Context) {
+
+	if r.raft == nil {
+
+		c.JSON(http.StatusNotFound, "Raft not enabled")
+		return
+	}
+
+	c.JSON(http.StatusOK, r.raft.raft.Stats())
+}
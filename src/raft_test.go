@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Raft nodes running in the test process over the in-memory transport, used to check replication without a deployment
+type raftHarness struct {
+	ids       []raft.ServerID
+	nodes     map[raft.ServerID]*raftNode
+	receivers map[raft.ServerID]*Receivers
+	stopped   map[raft.ServerID]bool
+}
+
+const harnessTimeout = 10 * time.Second
+
+func newRaftHarness(t *testing.T, size int) *raftHarness {
+
+	t.Helper()
+
+	cfg, _, _, err := parseConfig([]string{"-log-sinks=stdout", "-log-level=error"})
+
+	if err != nil {
+		t.Fatalf("configuration not loaded: %v", err)
+	}
+
+	currentConfig.Store(cfg)
+	initLogging()
+
+	h := &raftHarness{
+		nodes:     map[raft.ServerID]*raftNode{},
+		receivers: map[raft.ServerID]*Receivers{},
+		stopped:   map[raft.ServerID]bool{},
+	}
+
+	transports := map[raft.ServerID]*raft.InmemTransport{}
+	var servers []raft.Server
+
+	for i := 1; i <= size; i++ {
+
+		id := raft.ServerID(fmt.Sprintf("node-%d", i))
+		address, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+
+		h.ids = append(h.ids, id)
+		transports[id] = transport
+		servers = append(servers, raft.Server{ID: id, Address: address})
+	}
+
+	for _, id := range h.ids {
+
+		for _, peer := range h.ids {
+
+			if peer != id {
+				transports[id].Connect(raft.ServerAddress(peer), transports[peer])
+			}
+		}
+	}
+
+	for _, id := range h.ids {
+
+		conf := raftConfig(id)
+		conf.HeartbeatTimeout = 200 * time.Millisecond
+		conf.ElectionTimeout = 200 * time.Millisecond
+		conf.LeaderLeaseTimeout = 100 * time.Millisecond
+
+		r := &Receivers{eb: newEventBroker()}
+		store := raft.NewInmemStore()
+		node, err := r.newRaftNode(conf, store, store, raft.NewInmemSnapshotStore(), transports[id])
+
+		if err != nil {
+			t.Fatalf("raft node not started: %v", err)
+		}
+
+		//followers send writes straight to the leader node instead of POST /internal/raft/apply
+		node.forward = func(ctx context.Context, leader raft.ServerID, change StateChange) error {
+
+			if h.stopped[leader] {
+				return errNoLeader
+			}
+
+			return h.nodes[leader].apply(ctx, change)
+		}
+
+		h.nodes[id] = node
+		h.receivers[id] = r
+	}
+
+	t.Cleanup(h.shutdown)
+
+	if err = h.nodes[h.ids[0]].raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+		t.Fatalf("cluster not bootstrapped: %v", err)
+	}
+
+	return h
+}
+
+//Waiting until condition holds or harnessTimeout elapses
+func waitUntil(condition func() bool) bool {
+
+	deadline := time.Now().Add(harnessTimeout)
+
+	for time.Now().Before(deadline) {
+
+		if condition() {
+			return true
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return false
+}
+
+//Getting the leader elected among running nodes
+func (h *raftHarness) leader(t *testing.T) raft.ServerID {
+
+	t.Helper()
+
+	var leader raft.ServerID
+
+	found := waitUntil(func() bool {
+
+		for _, id := range h.ids {
+
+			if !h.stopped[id] && h.nodes[id].raft.State() == raft.Leader {
+
+				leader = id
+				return true
+			}
+		}
+
+		return false
+	})
+
+	if !found {
+		t.Fatal(errNoLeader)
+	}
+
+	return leader
+}
+
+func (h *raftHarness) follower() raft.ServerID {
+
+	for _, id := range h.ids {
+
+		if !h.stopped[id] && h.nodes[id].raft.State() != raft.Leader {
+			return id
+		}
+	}
+
+	return ""
+}
+
+//Checking that running nodes reach the expected state
+func (h *raftHarness) converged(t *testing.T, expected func(BrokerState) bool) {
+
+	t.Helper()
+
+	var states map[raft.ServerID]BrokerState
+
+	ok := waitUntil(func() bool {
+
+		states = map[raft.ServerID]BrokerState{}
+		var first *BrokerState
+
+		for _, id := range h.ids {
+
+			if h.stopped[id] {
+				continue
+			}
+
+			state := h.receivers[id].eb.state()
+			states[id] = state
+
+			if !expected(state) || (first != nil && !reflect.DeepEqual(*first, state)) {
+				return false
+			}
+
+			first = &state
+		}
+
+		return true
+	})
+
+	if !ok {
+		t.Fatalf("nodes did not converge: %+v", states)
+	}
+}
+
+func (h *raftHarness) shutdown() {
+
+	for _, id := range h.ids {
+
+		if !h.stopped[id] {
+
+			h.nodes[id].shutdown()
+			h.stopped[id] = true
+		}
+	}
+}
+
+//Checks run in order on the same three nodes, failover comes last since it stops the leader
+func TestRaftCluster(t *testing.T) {
+
+	h := newRaftHarness(t, 3)
+
+	t.Run("leader forwarding", h.testForwarding)
+	t.Run("snapshot and restore", h.testSnapshot)
+	t.Run("leader failover", h.testFailover)
+}
+
+//Writing through a follower, the leader must commit and every node apply the changes
+func (h *raftHarness) testForwarding(t *testing.T) {
+
+	h.leader(t)
+
+	node := h.nodes[h.follower()]
+	retention, partitions := 30, 4
+
+	changes := []StateChange{
+		{Op: changeDefineTopic, Topic: "harness", Definition: &TopicDefinition{Name: "harness", Retention: &retention,
+			Partitions: &partitions}},
+		{Op: changeSubscribe, Topic: "harness", Subscriber: "alice@example.com", Filter: `price < 500`},
+		{Op: changeSubscribe, Topic: "harness", Subscriber: "bob@example.com"},
+		{Op: changeUnsubscribe, Topic: "harness", Subscriber: "bob@example.com"},
+		{Op: changeStoreRequest, Request: &PublishedRequest{RequestID: "request-1", Topic: "harness", InsertionTime: time.Now()}},
+		{Op: changeStoreRequest, Request: &PublishedRequest{RequestID: "request-2", Topic: "harness", InsertionTime: time.Now()}},
+		{Op: changeDeleteRequest, RequestID: "request-1"},
+	}
+
+	for _, change := range changes {
+
+		if err := node.apply(context.Background(), change); err != nil {
+			t.Fatalf("%s not applied: %v", change.Op, err)
+		}
+	}
+
+	h.converged(t, func(state BrokerState) bool {
+
+		_, removed := state.Requests["request-1"]
+		_, stored := state.Requests["request-2"]
+
+		definition := state.Definitions["harness"]
+
+		return stringInSlice("harness", state.Topics) && definition.Retention != nil && *definition.Retention == retention &&
+			definition.Partitions != nil && *definition.Partitions == partitions &&
+			stringInSlice("harness", state.Subscriptions["alice@example.com"]) &&
+			state.Filters["alice@example.com"]["harness"] == `price < 500` &&
+			!stringInSlice("harness", state.Subscriptions["bob@example.com"]) && !removed && stored
+	})
+}
+
+//Taking a snapshot on the leader and restoring it on an empty broker
+func (h *raftHarness) testSnapshot(t *testing.T) {
+
+	leader := h.leader(t)
+
+	if err := h.nodes[leader].raft.Snapshot().Error(); err != nil {
+		t.Fatalf("snapshot not taken: %v", err)
+	}
+
+	source := h.receivers[leader]
+	snapshot, err := (&brokerFSM{source}).Snapshot()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := raft.NewInmemSnapshotStore()
+	sink, err := store.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	_, data, err := store.Open(sink.ID())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &Receivers{eb: newEventBroker()}
+
+	if err = (&brokerFSM{restored}).Restore(data); err != nil {
+		t.Fatalf("snapshot not restored: %v", err)
+	}
+
+	if !reflect.DeepEqual(source.eb.state(), restored.eb.state()) {
+		t.Fatalf("restored state differs: %+v", restored.eb.state())
+	}
+}
+
+//Stopping the leader, the remaining nodes must elect a new one in a new term and keep accepting writes
+func (h *raftHarness) testFailover(t *testing.T) {
+
+	leader := h.leader(t)
+	term := h.nodes[leader].term()
+
+	h.nodes[leader].shutdown()
+	h.stopped[leader] = true
+
+	//messages of the new owner must carry a higher term than the ones of the stopped leader
+	if next := h.nodes[h.leader(t)].term(); next <= term {
+		t.Fatalf("expected a term higher than %d, got %d", term, next)
+	}
+
+	change := StateChange{Op: changeSubscribe, Topic: "harness", Subscriber: "carol@example.com"}
+
+	if err := h.nodes[h.follower()].apply(context.Background(), change); err != nil {
+		t.Fatalf("%s not applied: %v", change.Op, err)
+	}
+
+	h.converged(t, func(state BrokerState) bool {
+		return stringInSlice("harness", state.Subscriptions["carol@example.com"])
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Roles daily quotas are configured for, administrators are the users in admin-users
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+//Token bucket refilled with rate tokens per second up to burst tokens, every publish takes a token
+type rateBucket struct {
+	scope string //user, api-key or topic
+	key   string
+	rate  float64
+	burst int
+}
+
+//Buckets and daily quota are checked in one script, so that tokens are taken only when every limit allows the publish and
+//instances sharing Redis see the same counts.
+//KEYS: bucket keys, then the quota key. ARGV: now (ms), bucket count, rate and burst of every bucket, quota, quota ttl (ms).
+//Returns 0 and 0 if allowed, otherwise the position of the exceeded limit (buckets first, quota last) and the wait in ms
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local count = tonumber(ARGV[2])
+local tokens = {}
+local limited, wait = 0, 0
+
+for i = 1, count do
+
+	local rate, burst = tonumber(ARGV[1 + 2 * i]), tonumber(ARGV[2 + 2 * i])
+	local bucket = redis.call('HMGET', KEYS[i], 'tokens', 'updated')
+	local available = tonumber(bucket[1]) or burst
+	local updated = tonumber(bucket[2]) or now
+
+	tokens[i] = math.min(burst, available + math.max(0, now - updated) * rate / 1000)
+
+	if tokens[i] < 1 then
+
+		local bucketWait = math.ceil((1 - tokens[i]) * 1000 / rate)
+
+		if bucketWait > wait then
+			limited, wait = i, bucketWait
+		end
+	end
+end
+
+if limited > 0 then
+	return {limited, wait}
+end
+
+local quota, quotaTTL = tonumber(ARGV[3 + 2 * count]), tonumber(ARGV[4 + 2 * count])
+
+if quota > 0 then
+
+	if tonumber(redis.call('GET', KEYS[count + 1]) or '0') >= quota then
+		return {count + 1, quotaTTL}
+	end
+
+	redis.call('INCR', KEYS[count + 1])
+	redis.call('PEXPIRE', KEYS[count + 1], quotaTTL)
+end
+
+for i = 1, count do
+
+	local rate, burst = tonumber(ARGV[1 + 2 * i]), tonumber(ARGV[2 + 2 * i])
+
+	redis.call('HSET', KEYS[i], 'tokens', tokens[i] - 1, 'updated', now)
+	redis.call('PEXPIRE', KEYS[i], math.ceil(burst * 1000 / rate))
+end
+
+return {0, 0}
+`)
+
+//Parsing daily-quotas: comma separated <role>=<publishes per day>, roles not listed have no quota
+func dailyQuotas(quotas string) (map[string]int64, error) {
+
+	result := map[string]int64{}
+
+	for _, quota := range strings.Split(quotas, ",") {
+
+		if quota = strings.TrimSpace(quota); quota == "" {
+			continue
+		}
+
+		parts := strings.SplitN(quota, "=", 2)
+
+		if len(parts) != 2 || (parts[0] != roleAdmin && parts[0] != roleUser) {
+			return nil, fmt.Errorf("invalid daily quota %q", quota)
+		}
+
+		value, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid daily quota %q", quota)
+		}
+
+		result[parts[0]] = value
+	}
+
+	return result, nil
+}
+
+func userRole(email string) string {
+
+	if stringInSlice(email, config().adminUsers()) {
+		return roleAdmin
+	}
+
+	return roleUser
+}
+
+//Getting buckets limiting a publish of user with session token accessUuid on topic, limits set to 0 are skipped and so is
+//the api-key bucket of publishes without token, e.g. over MQTT
+func publishBuckets(email string, accessUuid string, topic string) []rateBucket {
+
+	candidates := []rateBucket{
+		{"user", "ratelimit:user:" + email, config().RateLimitUser, config().RateLimitUserBurst},
+		{"api-key", "ratelimit:key:" + accessUuid, config().RateLimitAPIKey, config().RateLimitAPIKeyBurst},
+		{"topic", "ratelimit:topic:" + topic, config().RateLimitTopic, config().RateLimitTopicBurst},
+	}
+
+	var buckets []rateBucket
+
+	for _, bucket := range candidates {
+
+		if bucket.rate > 0 && (bucket.scope != "api-key" || accessUuid != "") {
+
+			//at least one token, otherwise no publish would ever be allowed
+			bucket.burst = max(bucket.burst, 1)
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets
+}
+
+//Checking rate limits and daily quota of a publish. Returns the exceeded limit and when the client may try again, or an
+//empty string if the publish is allowed
+func allowPublish(ctx context.Context, email string, accessUuid string, topic string) (string, time.Duration, error) {
+
+	buckets := publishBuckets(email, accessUuid, topic)
+	quotas, _ := dailyQuotas(config().DailyQuotas)
+	quota := quotas[userRole(email)]
+
+	if len(buckets) == 0 && quota == 0 {
+		return "", 0, nil
+	}
+
+	//quotas reset at midnight UTC
+	now := time.Now().UTC()
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+
+	var keys []string
+	args := []interface{}{now.UnixMilli(), len(buckets)}
+
+	for _, bucket := range buckets {
+
+		keys = append(keys, bucket.key)
+		args = append(args, bucket.rate, bucket.burst)
+	}
+
+	keys = append(keys, "quota:"+email+":"+now.Format("2006-01-02"))
+	args = append(args, quota, midnight.Sub(now).Milliseconds()+1)
+
+	reply, err := rateLimitScript.Run(ctx, client, keys, args...).Int64Slice()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	if reply[0] == 0 {
+		return "", 0, nil
+	}
+
+	wait := time.Duration(reply[1]) * time.Millisecond
+
+	if int(reply[0]) > len(buckets) {
+		return "daily quota", wait, nil
+	}
+
+	return buckets[reply[0]-1].scope + " rate limit", wait, nil
+}
+
+//Getting the limit exceeded by a publish and when the client may try again, empty if the publish is allowed. Publishes
+//are allowed when rate limits are disabled or Redis is not available
+func exceededLimit(ctx context.Context, email string, accessUuid string, topic string) (string, time.Duration) {
+
+	if !config().RateLimitEnabled {
+		return "", 0
+	}
+
+	limit, wait, err := allowPublish(ctx, email, accessUuid, topic)
+
+	if err != nil {
+
+		loggerFrom(ctx).Warn("rate limits not checked", "error", err)
+		return "", 0
+	}
+
+	if limit != "" {
+		rateLimited.WithLabelValues(strings.Fields(limit)[0]).Inc()
+	}
+
+	return limit, wait
+}
+
+//Answering 429 if publish of the session user on topic exceeds a limit. Returns false if the request has been answered
+func checkPublishLimits(c *gin.Context, email string, topic string) bool {
+
+	accessUuid := ""
+
+	if tokenAuth, err := ExtractTokenMetadata(c); err == nil && tokenAuth != nil {
+		accessUuid = tokenAuth.AccessUuid
+	}
+
+	limit, wait := exceededLimit(c.Request.Context(), email, accessUuid, topic)
+
+	if limit == "" {
+		return true
+	}
+
+	withLogFields(c, "limit", limit)
+
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, PublishResult{Result: "rejected", Reason: limit + " exceeded"})
+
+	return false
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
-	"log"
-	"os"
 )
 
 var client *redis.Client
@@ -12,21 +10,19 @@ var ctx = context.Background()
 
 func initRedis() {
 
-	dsn := os.Getenv("REDIS_DSN")
-
-	if len(dsn) == 0 {
-		dsn = "localhost:6379" //localhost configuration
-		//dsn = "18.211.56.181:6379" //EC2 configuration
-	}
-
 	client = redis.NewClient(&redis.Options{
-		Addr:     dsn,
-		Password: "empires",
+		Addr:     config().RedisAddress,
+		Password: config().RedisPassword,
 	})
 
-	_, err := client.Ping(ctx).Result()
+	client.AddHook(redisMetricsHook{})
+	client.AddHook(redisTracingHook{})
+
+	err := retryOnStartup("Redis", func() error {
+		return client.Ping(ctx).Err()
+	})
 
 	if err != nil {
-		log.Panic(err)
+		fatal("Redis not available", err, "address", config().RedisAddress)
 	}
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type ConfigReload struct {
+	Applied         []string `json:"Applied"`
+	RequiresRestart []string `json:"RequiresRestart"`
+}
+
+//Closed and replaced on every reload, waking up garbage collectors
+var reloadSignal = make(chan struct{})
+var reloadLock sync.Mutex
+
+//Parsing configuration again and applying settings tagged reload, changes to other settings are only reported
+func reloadConfig() (ConfigReload, error) {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, _, _, err := parseConfig(configArgs)
+
+	if err != nil {
+		return ConfigReload{}, err
+	}
+
+	current := config()
+	next := *current
+	report := ConfigReload{Applied: []string{}, RequiresRestart: []string{}}
+
+	currentValue, loadedValue, nextValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(loaded).Elem(), reflect.ValueOf(&next).Elem()
+
+	for i, key := range configKeys() {
+
+		if reflect.DeepEqual(currentValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			continue
+		}
+
+		if key.reload {
+
+			nextValue.Field(i).Set(loadedValue.Field(i))
+			report.Applied = append(report.Applied, key.name)
+
+		} else {
+
+			report.RequiresRestart = append(report.RequiresRestart, key.name)
+		}
+	}
+
+	currentConfig.Store(&next)
+	setLogLevel(next.LogLevel)
+
+	close(reloadSignal)
+	reloadSignal = make(chan struct{})
+
+	slog.Info("configuration reloaded", "applied", report.Applied, "requires_restart", report.RequiresRestart)
+
+	return report, nil
+}
+
+//Getting channel closed by next reload
+func nextReload() <-chan struct{} {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	return reloadSignal
+}
+
+//Waiting until period minutes after last sweep, period is read again on reload. Returns false if shutdown started meanwhile
+func waitForSweep(last time.Time, period func() int) bool {
+
+	for {
+
+		reloaded := nextReload()
+		timer := time.NewTimer(time.Until(last.Add(time.Minute * time.Duration(period()))))
+
+		select {
+
+		case <-shutdownSignal:
+			timer.Stop()
+			return false
+
+		case <-timer.C:
+			return true
+
+		case <-reloaded:
+			timer.Stop()
+		}
+	}
+}
+
+//Reloading configuration on administrator request
+func reloadConfiguration(c *gin.Context) {
+
+	report, err := reloadConfig()
+
+	if err != nil {
+
+		loggerFrom(c.Request.Context()).Error("configuration not reloaded", "error", err)
+		c.JSON(http.StatusUnprocessableEntity, "Configuration not reloaded: "+err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Getting how long topic messages are kept for replay after their expiration
+func (eb *EventBroker) retention(topic string) time.Duration {
+
+	eb.rm.RLock()
+	retention := eb.definitions[topic].Retention
+	eb.rm.RUnlock()
+
+	if retention == nil {
+		return time.Minute * time.Duration(config().MessageRetention)
+	}
+
+	return time.Minute * time.Duration(*retention)
+}
+
+//Deleting from replay log messages whose retention is elapsed
+func (r *Receivers) deleteMessageFromLog(topic string) {
+
+	limit := time.Now().Local().Add(-r.eb.retention(topic))
+
+	r.eb.queue(topic).removeLog(func(message MessageData) bool {
+		return !limit.Before(message.ExpirationTime)
+	})
+}
+
+//Replaying topic messages ordered by offset, starting from an offset and/or an insertion timestamp (RFC 3339),
+//optionally only those within radius km (plus message radius) from latitude and longitude
+func (r *Receivers) replay(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	topic := c.Query("topic")
+
+	if !r.eb.hasTopic(topic) {
+
+		c.JSON(http.StatusBadRequest, "Unknown topic "+topic)
+		return
+	}
+
+	if !r.eb.canAccess(topic, email) {
+
+		c.JSON(http.StatusForbidden, "Not a member of private topic "+topic)
+		return
+	}
+
+	var offset int64
+	var from time.Time
+
+	if value := c.Query("offset"); value != "" {
+
+		offset, err = strconv.ParseInt(value, 10, 64)
+
+		if err != nil {
+
+			c.JSON(http.StatusBadRequest, "Invalid offset")
+			return
+		}
+	}
+
+	if value := c.Query("from"); value != "" {
+
+		from, err = time.Parse(time.RFC3339, value)
+
+		if err != nil {
+
+			c.JSON(http.StatusBadRequest, "Invalid timestamp, RFC 3339 format is required")
+			return
+		}
+	}
+
+	limit := config().ReplayLimit
+
+	if value := c.Query("limit"); value != "" {
+
+		limit, err = strconv.Atoi(value)
+
+		if err != nil || limit <= 0 || limit > config().ReplayLimit {
+			limit = config().ReplayLimit
+		}
+	}
+
+	var subscriber *MessageData
+
+	if value := c.Query("radius"); value != "" {
+
+		subscriber = &MessageData{}
+		subscriber.Radius, err = strconv.Atoi(value)
+
+		if err == nil {
+			subscriber.Latitude, err = strconv.ParseFloat(c.Query("latitude"), 64)
+		}
+
+		if err == nil {
+			subscriber.Longitude, err = strconv.ParseFloat(c.Query("longitude"), 64)
+		}
+
+		if err != nil {
+
+			c.JSON(http.StatusBadRequest, "Invalid position, radius, latitude and longitude are required")
+			return
+		}
+	}
+
+	if config().PostGISEnabled {
+
+		results, err := r.dbServer.replayMessages(c.Request.Context(), topic, offset, from, limit, subscriber)
+
+		if err != nil {
+
+			dbErrors.WithLabelValues("select-replay").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, results)
+		return
+	}
+
+	results := MessageDataSlice{}
+
+	for _, message := range r.eb.logMessages(topic) {
+
+		if len(results) == limit {
+			break
+		}
+
+		if message.Offset >= offset && !message.InsertionTime.Before(from) && (subscriber == nil ||
+			checkDistance(subscriber.Latitude, message.Latitude, subscriber.Longitude, message.Longitude, subscriber.Radius, message.Radius)) {
+
+			results = append(results, message)
+		}
+	}
+
+	c.JSON(http.StatusOK, results)
+}
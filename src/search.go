@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//Inverted index over Title and Message of the active messages of a topic, kept up to date by its partitions
+type searchIndex struct {
+	postings map[string]map[string]bool //key: token - value: ids of messages containing it
+	messages map[string]MessageData     //key: message id
+	rm       sync.RWMutex
+}
+
+//Body of search requests: messages containing every word of Query, on Topics (all topics if empty) and, when Radius is
+//given, in range of the position as notifications are
+type SearchRequest struct {
+	Query     string  `json:"Query"`
+	Topics    Topics  `json:"Topics"`
+	Latitude  float64 `json:"Latitude"`
+	Longitude float64 `json:"Longitude"`
+	Radius    int     `json:"Radius,string"`
+	Limit     int     `json:"Limit"`
+}
+
+//Postgres document searched when search-backend is postgres, matching the expression index of migration 0013
+const searchDocument = `to_tsvector('simple', COALESCE(title, '') || ' ' || COALESCE(payload, ''))`
+
+//Messages read from db on each page of a search by radius without PostGIS, as multiple of the limit
+const searchPageFactor = 4
+
+//Creating index of a topic, nil when search is served by Postgres
+func newSearchIndex() *searchIndex {
+
+	if config().SearchBackend != "memory" {
+		return nil
+	}
+
+	return &searchIndex{postings: map[string]map[string]bool{}, messages: map[string]MessageData{}}
+}
+
+//Splitting text into lower case words, without duplicates
+func searchTokens(text string) []string {
+
+	var tokens []string
+	seen := map[string]bool{}
+
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+
+		if !seen[word] {
+
+			seen[word] = true
+			tokens = append(tokens, word)
+		}
+	}
+
+	return tokens
+}
+
+func (index *searchIndex) add(message MessageData) {
+
+	if index == nil {
+		return
+	}
+
+	index.rm.Lock()
+	defer index.rm.Unlock()
+
+	index.messages[message.ID] = message
+
+	for _, token := range searchTokens(message.Title + " " + message.Message) {
+
+		if index.postings[token] == nil {
+			index.postings[token] = map[string]bool{}
+		}
+
+		index.postings[token][message.ID] = true
+	}
+}
+
+func (index *searchIndex) remove(messages ...MessageData) {
+
+	if index == nil || len(messages) == 0 {
+		return
+	}
+
+	index.rm.Lock()
+	defer index.rm.Unlock()
+
+	for _, message := range messages {
+
+		delete(index.messages, message.ID)
+
+		for _, token := range searchTokens(message.Title + " " + message.Message) {
+
+			delete(index.postings[token], message.ID)
+
+			if len(index.postings[token]) == 0 {
+				delete(index.postings, token)
+			}
+		}
+	}
+}
+
+//Getting active messages containing every token and accepted by match
+func (index *searchIndex) search(tokens []string, match func(message MessageData) bool) MessageDataSlice {
+
+	var result MessageDataSlice
+
+	if index == nil || len(tokens) == 0 {
+		return result
+	}
+
+	index.rm.RLock()
+	defer index.rm.RUnlock()
+
+	//walking the shortest posting list, the others are only looked up
+	shortest := index.postings[tokens[0]]
+
+	for _, token := range tokens[1:] {
+
+		if len(index.postings[token]) < len(shortest) {
+			shortest = index.postings[token]
+		}
+	}
+
+	for id := range shortest {
+
+		found := true
+
+		for _, token := range tokens {
+
+			if !index.postings[token][id] {
+
+				found = false
+				break
+			}
+		}
+
+		if found && match(index.messages[id]) {
+			result = append(result, index.messages[id])
+		}
+	}
+
+	return result
+}
+
+//Reading active messages matching the words of query from db, at most limit in range of the position. With PostGIS the
+//distance is checked by the query, otherwise afterwards on pages of searchPageFactor*limit messages
+func (s *server) searchMessages(ctx context.Context, topics Topics, request SearchRequest, limit int) (MessageDataSlice, error) {
+
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages WHERE topic = ANY($1) AND lifetime > $2 AND ` + searchDocument +
+		` @@ plainto_tsquery('simple', $3)`
+	args := []interface{}{pq.Array(topics), time.Now().Local(), request.Query}
+	page := limit
+
+	if config().PostGISEnabled && request.Radius > 0 {
+
+		sqlStatement += ` AND ` + fmt.Sprintf(withinDistance, 4, 5, 6)
+		args = append(args, request.Longitude, request.Latitude, request.Radius)
+
+	} else if request.Radius > 0 {
+		page = searchPageFactor * limit
+	}
+
+	sqlStatement += fmt.Sprintf(` ORDER BY insertion_time DESC NULLS LAST, id DESC LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	results := MessageDataSlice{}
+
+	for offset := 0; ; offset += page {
+
+		sqlCtx, span := startSQLSpan(ctx, "SELECT", "messages")
+		rows, err := s.db.QueryContext(sqlCtx, sqlStatement, append(args, page, offset)...)
+
+		if err != nil {
+
+			endSpan(span, err)
+			return nil, err
+		}
+
+		messages, err := scanMessages(rows)
+		endSpan(span, err)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+
+			if config().PostGISEnabled || request.inRange(message) {
+				results = append(results, message)
+			}
+		}
+
+		if len(results) >= limit || len(messages) < page {
+			return results, nil
+		}
+	}
+}
+
+//Checking if message is in range of the position of a search, as notifications do
+func (request SearchRequest) inRange(message MessageData) bool {
+
+	return request.Radius <= 0 ||
+		checkDistance(request.Latitude, message.Latitude, request.Longitude, message.Longitude, request.Radius, message.Radius)
+}
+
+//Searching active messages by keyword, newest first
+func (r *Receivers) search(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var request SearchRequest
+	err = json.NewDecoder(c.Request.Body).Decode(&request)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tokens := searchTokens(request.Query)
+
+	if len(tokens) == 0 {
+		c.JSON(http.StatusBadRequest, "Query must contain at least a word")
+		return
+	}
+
+	limit := config().SearchLimit
+
+	if request.Limit > 0 && request.Limit < limit {
+		limit = request.Limit
+	}
+
+	//requested topics that exist and user can access, all of them by default
+	topics := r.eb.accessibleTopics(r.eb.topicList(), email)
+
+	if len(request.Topics) > 0 {
+
+		var requested Topics
+
+		for _, topic := range request.Topics {
+
+			if stringInSlice(topic, topics) {
+				requested = append(requested, topic)
+			}
+		}
+
+		topics = requested
+	}
+
+	withLogFields(c, "query", request.Query)
+	spanCtx, span := tracer.Start(c.Request.Context(), "search messages")
+	results := MessageDataSlice{}
+
+	if config().SearchBackend == "postgres" {
+
+		results, err = r.dbServer.searchMessages(spanCtx, topics, request, limit)
+
+		if err != nil {
+
+			span.End()
+			dbErrors.WithLabelValues("search-messages").Inc()
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+	} else {
+
+		now := time.Now().Local()
+
+		for _, topic := range topics {
+
+			if q := r.eb.findQueue(topic); q != nil {
+
+				results = append(results, q.index.search(tokens, func(message MessageData) bool {
+					return now.Before(message.ExpirationTime) && request.inRange(message)
+				})...)
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].InsertionTime.After(results[j].InsertionTime)
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	span.SetAttributes(attribute.Int("sdcc.search_results", len(results)))
+	span.End()
+
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Closed on shutdown to stop garbage collectors and pending webhook retries
+var shutdownSignal = make(chan struct{})
+
+//Garbage collector sweeps and webhook deliveries to wait for on shutdown
+var backgroundWorkers workerGroup
+
+//WaitGroup refusing new workers once shutdown waits for them, so that Add never runs concurrently with Wait
+type workerGroup struct {
+	wg       sync.WaitGroup
+	stopping bool
+	rm       sync.Mutex
+}
+
+//Counting a worker about to start, returns false if shutdown started and the work must be skipped
+func (g *workerGroup) start() bool {
+
+	g.rm.Lock()
+	defer g.rm.Unlock()
+
+	if g.stopping {
+		return false
+	}
+
+	g.wg.Add(1)
+
+	return true
+}
+
+func (g *workerGroup) done() {
+
+	g.wg.Done()
+}
+
+//Refusing new workers and waiting for the running ones
+func (g *workerGroup) wait() {
+
+	g.rm.Lock()
+	g.stopping = true
+	g.rm.Unlock()
+
+	g.wg.Wait()
+}
+
+//Waiting for period, returning false if shutdown started meanwhile
+func sleepOrShutdown(period time.Duration) bool {
+
+	select {
+
+	case <-shutdownSignal:
+		return false
+
+	case <-time.After(period):
+		return true
+	}
+}
+
+//Starting to accept HTTP requests, the returned channel gets the error stopping the server
+func listen(server *http.Server) <-chan error {
+
+	serverErrors := make(chan error, 1)
+
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	return serverErrors
+}
+
+//Serving HTTP requests until SIGINT or SIGTERM, then shutting down within shutdown-timeout. SIGHUP reloads configuration
+func (r *Receivers) serve(server *http.Server, serverErrors <-chan error, db *sql.DB) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for running := true; running; {
+
+		select {
+
+		case err := <-serverErrors:
+			fatal("HTTP server stopped", err)
+
+		case sig := <-signals:
+
+			if sig == syscall.SIGHUP {
+
+				if _, err := reloadConfig(); err != nil {
+					slog.Error("configuration not reloaded", "error", err)
+				}
+
+				continue
+			}
+
+			slog.Info("shutting down", "signal", sig.String())
+			running = false
+		}
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(config().ShutdownTimeout))
+	defer cancel()
+
+	//stopping listener and draining in-flight requests
+	err := server.Shutdown(deadline)
+
+	if err != nil {
+		slog.Error("HTTP server not drained", "error", err)
+	}
+
+	close(shutdownSignal)
+
+	if r.mqtt != nil {
+		r.mqtt.close()
+	}
+
+	if r.raft != nil {
+		r.raft.shutdown()
+	}
+
+	//waiting for garbage collector sweeps and webhook deliveries
+	done := make(chan struct{})
+
+	go func() {
+		backgroundWorkers.wait()
+		close(done)
+	}()
+
+	select {
+
+	case <-done:
+
+	case <-deadline.Done():
+		slog.Warn("shutdown deadline exceeded, abandoning background work")
+	}
+
+	if tracerProvider != nil {
+
+		err = tracerProvider.Shutdown(deadline)
+
+		if err != nil {
+			slog.Error("spans not flushed", "error", err)
+		}
+	}
+
+	err = client.Close()
+
+	if err != nil {
+		slog.Error("Redis connection not closed", "error", err)
+	}
+
+	err = db.Close()
+
+	if err != nil {
+		slog.Error("Postgres connection not closed", "error", err)
+	}
+
+	slog.Info("shutdown completed")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+var tracer = otel.Tracer("github.com/GiggiC/sdcc_go")
+
+//Set when an exporter is configured, flushed on shutdown
+var tracerProvider *sdktrace.TracerProvider
+
+//Configuring propagation and, if enabled, span exporter
+func initTracing() {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch config().TracingExporter {
+
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+
+	case "otlp":
+
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config().TracingEndpoint)}
+
+		if config().TracingInsecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+
+	default:
+		return
+	}
+
+	if err != nil {
+		fatal("tracing exporter not created", err, "exporter", config().TracingExporter)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config().TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(config().TracingServiceName))),
+	)
+
+	otel.SetTracerProvider(tracerProvider)
+}
+
+//Starting a span for every request, continuing trace context sent by the client
+func TracingMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+//Starting a client span for a SQL statement
+func startSQLSpan(ctx context.Context, operation string, table string) (context.Context, trace.Span) {
+
+	return tracer.Start(ctx, operation+" "+table, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationName(operation),
+			semconv.DBCollectionName(table),
+		))
+}
+
+//Ending span, recording error if any
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+//Copying trace context of ctx into message metadata
+func injectTraceContext(ctx context.Context, message *MessageData) {
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	if len(carrier) > 0 {
+		message.TraceContext = carrier
+	}
+}
+
+//Starting a span for a subscriber delivery as child of the publish span stored in message metadata
+func startDeliverySpan(message MessageData, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(message.TraceContext))
+
+	attributes = append(attributes, attribute.String("messaging.destination.name", message.Topic),
+		attribute.String("messaging.message.id", message.ID))
+
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attributes...))
+}
+
+//Tracing Redis commands issued within a traced request
+type redisTracingHook struct{}
+
+func (redisTracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, nil
+	}
+
+	ctx, _ = tracer.Start(ctx, "redis "+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis))
+
+	return ctx, nil
+}
+
+func (redisTracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+
+	span := trace.SpanFromContext(ctx)
+
+	if !span.IsRecording() {
+		return nil
+	}
+
+	err := cmd.Err()
+
+	if err == redis.Nil {
+		err = nil
+	}
+
+	endSpan(span, err)
+
+	return nil
+}
+
+func (redisTracingHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+
+	return ctx, nil
+}
+
+func (redisTracingHook) AfterProcessPipeline(_ context.Context, _ []redis.Cmder) error {
+
+	return nil
+}
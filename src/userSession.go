@@ -3,9 +3,9 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -43,9 +43,12 @@ func (s *server) registration(c *gin.Context) {
 	err := json.NewDecoder(c.Request.Body).Decode(&user)
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
 	}
 
+	logger := withLogFields(c, "user", user.Email)
+
 	err = s.db.QueryRow("SELECT email FROM users WHERE email=$1", user.Email).Scan(&user)
 
 	httpCode := http.StatusOK
@@ -55,8 +58,8 @@ func (s *server) registration(c *gin.Context) {
 		hashedPassword, errPass := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 
 		if errPass != nil {
-			httpCode = http.StatusInternalServerError
-			log.Panic(errPass)
+			failRequest(c, http.StatusInternalServerError, errPass)
+			return
 		}
 
 		sqlStatement := `INSERT INTO users (email, password) VALUES ($1, $2)`
@@ -64,10 +67,13 @@ func (s *server) registration(c *gin.Context) {
 		_, errDB := s.db.Exec(sqlStatement, user.Email, hashedPassword)
 
 		if errDB != nil {
-			httpCode = http.StatusInternalServerError
-			log.Panic(errDB)
+			dbErrors.WithLabelValues("insert-user").Inc()
+			failRequest(c, http.StatusInternalServerError, errDB)
+			return
 		}
 
+		logger.Info("user registered")
+
 	} else {
 
 		httpCode = http.StatusConflict
@@ -111,39 +117,43 @@ func (s *server) login(c *gin.Context) {
 	err := json.NewDecoder(c.Request.Body).Decode(&user)
 
 	if err != nil {
-		log.Panic(err)
+		failRequest(c, http.StatusBadRequest, err)
+		return
 	}
 
-	var databaseEmail string
-	var databasePassword string
+	logger := withLogFields(c, "user", user.Email)
+
 	httpCode := http.StatusOK
 
-	err = s.db.QueryRow("SELECT email, password FROM users WHERE email=$1", user.Email).Scan(&databaseEmail, &databasePassword)
-
-	if err != nil {
+	if !s.authenticate(user.Email, user.Password) {
 
 		httpCode = http.StatusUnauthorized
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(databasePassword), []byte(user.Password))
+	var ts *TokenDetails
 
-	if err != nil {
+	if httpCode == http.StatusOK {
 
-		httpCode = http.StatusUnauthorized
-	}
+		ts, err = CreateToken(user.Email)
 
-	ts, err := CreateToken(user.Email)
+		if err == nil {
+			err = CreateAuth(c.Request.Context(), user.Email, ts)
+		}
 
-	if err != nil {
+		if err != nil {
 
-		httpCode = http.StatusUnprocessableEntity
+			logger.Error("session not created", "error", err)
+			httpCode = http.StatusUnprocessableEntity
+		}
 	}
 
-	saveErr := CreateAuth(user.Email, ts)
+	if httpCode == http.StatusOK {
 
-	if saveErr != nil {
+		logger.Info("user logged in")
+
+	} else {
 
-		httpCode = http.StatusUnprocessableEntity
+		logger.Warn("login failed", "status", httpCode)
 	}
 
 	userAgent := c.Request.Header.Get("User-Agent")
@@ -184,16 +194,35 @@ func (s *server) login(c *gin.Context) {
 
 }
 
+//Checking user credentials against users table
+func (s *server) authenticate(email string, password string) bool {
+
+	var databasePassword string
+
+	err := s.db.QueryRow("SELECT password FROM users WHERE email=$1", email).Scan(&databasePassword)
+
+	if err != nil {
+
+		return false
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(databasePassword), []byte(password))
+
+	return err == nil
+}
+
 //Logging out user
 func logout(c *gin.Context) {
 
-	checkSession(c)
+	if _, err := checkSession(c); err != nil {
+		return
+	}
 
 	au, _ := ExtractTokenMetadata(c)
 	httpCode := http.StatusOK
 
 	//Deleting token from Redis db
-	deleted, delErr := DeleteAuth(au.AccessUuid)
+	deleted, delErr := DeleteAuth(c.Request.Context(), au.AccessUuid)
 
 	if delErr != nil || deleted == 0 {
 
@@ -237,19 +266,31 @@ func logout(c *gin.Context) {
 
 }
 
-//Checking user session and permission
-func checkSession(c *gin.Context) string {
+//Checking user session and permission, redirecting to login page if not valid
+func checkSession(c *gin.Context) (string, error) {
 
-	tokenAuth, exErr := ExtractTokenMetadata(c)
-	fErr := FetchAuth(tokenAuth)
+	tokenAuth, err := ExtractTokenMetadata(c)
 
-	if exErr != nil || fErr != nil {
+	if err == nil && tokenAuth == nil {
+		err = errors.New("invalid token")
+	}
 
+	if err == nil {
+		err = FetchAuth(c.Request.Context(), tokenAuth)
+	}
+
+	if err != nil {
+
+		loggerFrom(c.Request.Context()).Info("session not valid", "error", err)
 		redirect(c, "login.html", "not-logged", nil, false, http.StatusUnauthorized, "Login Page")
 		c.Abort()
+
+		return "", err
 	}
 
-	return tokenAuth.Email
+	withLogFields(c, "user", tokenAuth.Email)
+
+	return tokenAuth.Email, nil
 }
 
 //Redirecting function
@@ -259,7 +300,12 @@ func redirect(c *gin.Context, url string, status string, results interface{}, ch
 
 	if check {
 
-		email = checkSession(c)
+		var err error
+		email, err = checkSession(c)
+
+		if err != nil {
+			return
+		}
 	}
 
 	c.HTML(
@@ -270,7 +316,7 @@ func redirect(c *gin.Context, url string, status string, results interface{}, ch
 			"status":           status,
 			"results":          results,
 			"email":            email,
-			"deliverySemantic": deliverySemantic,
+			"deliverySemantic": config().DeliverySemantic,
 		},
 	)
 }
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/umahmood/haversine"
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/umahmood/haversine"
+)
 
 func remove(s []string, i int) []string {
 
@@ -33,3 +37,37 @@ func stringInSlice(a string, list []string) bool {
 
 	return false
 }
+
+//Getting value of a json column, null for empty maps and documents
+func jsonColumn(value interface{}) sql.NullString {
+
+	encoded, err := json.Marshal(value)
+
+	if err != nil || string(encoded) == "null" || string(encoded) == "{}" {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+//Getting value of the column of a JSON document, null only when there is none: an empty object is a document
+func documentColumn(document json.RawMessage) sql.NullString {
+
+	if len(document) == 0 || string(document) == "null" {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: string(document), Valid: true}
+}
+
+//Getting value of a nullable integer column, nil if null
+func nullableInt(value sql.NullInt64) *int {
+
+	if !value.Valid {
+		return nil
+	}
+
+	number := int(value.Int64)
+
+	return &number
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+func TestDocumentColumn(t *testing.T) {
+
+	tests := []struct {
+		document json.RawMessage
+		column   sql.NullString
+	}{
+		{nil, sql.NullString{}},
+		{json.RawMessage(`null`), sql.NullString{}},
+
+		//an empty object is a payload, it must come back from db
+		{json.RawMessage(`{}`), sql.NullString{String: `{}`, Valid: true}},
+		{json.RawMessage(`{"price": 450}`), sql.NullString{String: `{"price": 450}`, Valid: true}},
+	}
+
+	for _, test := range tests {
+
+		if column := documentColumn(test.document); column != test.column {
+			t.Fatalf("%q: expected %+v, got %+v", test.document, test.column, column)
+		}
+	}
+
+	//empty headers are stored as null
+	if column := jsonColumn(map[string]string{}); column.Valid {
+		t.Fatalf("expected null for empty headers, got %q", column.String)
+	}
+}
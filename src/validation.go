@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"io"
+	"sync"
+)
+
+//Compiled JSON Schemas by schema text, so that a schema is compiled once and not again on every node change
+var compiledSchemas sync.Map
+
+//Compiling JSON Schema of a topic, references to other documents are not loaded
+func compileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+
+	if compiled, found := compiledSchemas.Load(string(schema)); found {
+		return compiled.(*jsonschema.Schema), nil
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema reference %s not allowed", url)
+	}
+
+	if err := compiler.AddResource("sdcc:topic.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+
+	compiled, err := compiler.Compile("sdcc:topic.json")
+
+	if err != nil {
+		return nil, err
+	}
+
+	compiledSchemas.Store(string(schema), compiled)
+
+	return compiled, nil
+}
+
+//Compacting schema sent by an administrator, so that every node stores the same text. null removes the schema
+func normalizeSchema(schema json.RawMessage) json.RawMessage {
+
+	var compact bytes.Buffer
+
+	if json.Compact(&compact, schema) != nil {
+		return schema
+	}
+
+	if compact.String() == "null" {
+		return nil
+	}
+
+	return compact.Bytes()
+}
+
+//Checking that the message of a topic with schema is a JSON document conforming to it, other topics take free text
+func (eb *EventBroker) validatePayload(message MessageData) error {
+
+	eb.rm.RLock()
+	schema := eb.definitions[message.Topic].Schema
+	eb.rm.RUnlock()
+
+	if len(schema) == 0 {
+		return nil
+	}
+
+	compiled, err := compileSchema(schema)
+
+	if err != nil {
+		return fmt.Errorf("schema of the topic not valid: %w", err)
+	}
+
+	document, err := payloadDocument(message)
+
+	if err != nil {
+		return err
+	}
+
+	var payload interface{}
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&payload); err != nil {
+		return fmt.Errorf("message is not JSON: %w", err)
+	}
+
+	if decoder.More() {
+		return errors.New("message is not a single JSON document")
+	}
+
+	if err = compiled.Validate(payload); err != nil {
+		return fmt.Errorf("message does not match schema of the topic: %v", err)
+	}
+
+	return nil
+}
+
+//Checking position, radius, lifetime, payload fields and encryption of a message sent by a client
+func (eb *EventBroker) validateMessage(message MessageData) error {
+
+	var errs []error
+
+	if message.Latitude < -90 || message.Latitude > 90 {
+		errs = append(errs, errors.New("latitude must be between -90 and 90"))
+	}
+
+	if message.Longitude < -180 || message.Longitude > 180 {
+		errs = append(errs, errors.New("longitude must be between -180 and 180"))
+	}
+
+	if message.Radius <= 0 {
+		errs = append(errs, errors.New("radius must be positive"))
+
+	} else if maxRadius := eb.limits(message.Topic).maxRadius; maxRadius > 0 && message.Radius > maxRadius {
+		errs = append(errs, fmt.Errorf("radius must not exceed %d km, max-radius of the topic", maxRadius))
+	}
+
+	//longer lifetimes are lowered to max-lifetime of the topic on publish
+	if message.LifeTime <= 0 {
+		errs = append(errs, errors.New("lifetime must be positive"))
+	}
+
+	if len(message.Attachments) > 0 {
+		errs = append(errs, errors.New("attachments must be uploaded as files of a multipart publish"))
+	}
+
+	errs = append(errs, validatePayloadFields(message), eb.validateEncryption(message))
+
+	return errors.Join(errs...)
+}
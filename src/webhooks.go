@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Webhook struct {
+	ID         int     `json:"ID"`
+	Subscriber string  `json:"Subscriber"`
+	Topic      string  `json:"Topic"`
+	URL        string  `json:"URL"`
+	Secret     string  `json:"Secret,omitempty"`
+	Radius     int     `json:"Radius"` //0 means no distance filtering
+	Latitude   float64 `json:"Latitude"`
+	Longitude  float64 `json:"Longitude"`
+}
+
+type WebhookDeadLetter struct {
+	WebhookID int         `json:"WebhookID"`
+	URL       string      `json:"URL"`
+	Message   MessageData `json:"Message"`
+	Error     string      `json:"Error"`
+	Attempts  int         `json:"Attempts"`
+	FailedAt  time.Time   `json:"FailedAt"`
+}
+
+type webhookDispatcher struct {
+	r        *Receivers
+	webhooks map[string][]Webhook //key: topic - value: webhooks
+	client   *http.Client
+	rm       sync.RWMutex
+}
+
+//Loading registered webhooks and registering dispatcher as EventBroker listener
+func (r *Receivers) initWebhooks() {
+
+	r.hooks = &webhookDispatcher{
+		r:        r,
+		webhooks: map[string][]Webhook{},
+		client: &http.Client{
+			Timeout:   time.Millisecond * time.Duration(config().WebhookTimeout),
+			Transport: &http.Transport{DialContext: dialWebhook, TLSHandshakeTimeout: 10 * time.Second},
+		},
+	}
+
+	if err := r.hooks.load(); err != nil {
+		fatal("webhooks not loaded", err)
+	}
+
+	r.eb.addListener(r.hooks.dispatch)
+}
+
+//Reading all webhooks from db, replacing the loaded ones
+func (wd *webhookDispatcher) load() error {
+
+	rows, err := wd.r.dbServer.db.Query(`SELECT id, subscriber, topic, url, secret, radius, latitude, longitude FROM webhooks`)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	webhooks := map[string][]Webhook{}
+
+	for rows.Next() {
+
+		var webhook Webhook
+		err = rows.Scan(&webhook.ID, &webhook.Subscriber, &webhook.Topic, &webhook.URL, &webhook.Secret, &webhook.Radius,
+			&webhook.Latitude, &webhook.Longitude)
+
+		if err != nil {
+			return err
+		}
+
+		webhooks[webhook.Topic] = append(webhooks[webhook.Topic], webhook)
+	}
+
+	wd.rm.Lock()
+	wd.webhooks = webhooks
+	wd.rm.Unlock()
+
+	return rows.Err()
+}
+
+func (wd *webhookDispatcher) add(webhook Webhook) {
+
+	wd.rm.Lock()
+	wd.webhooks[webhook.Topic] = append(wd.webhooks[webhook.Topic], webhook)
+	wd.rm.Unlock()
+}
+
+func (wd *webhookDispatcher) remove(id int) {
+
+	wd.rm.Lock()
+
+	for topic, webhooks := range wd.webhooks {
+
+		for i := range webhooks {
+
+			if webhooks[i].ID == id {
+
+				wd.webhooks[topic] = append(webhooks[:i:i], webhooks[i+1:]...)
+				break
+			}
+		}
+	}
+
+	wd.rm.Unlock()
+}
+
+//Delivering accepted message to every webhook of its topic within the geo area
+func (wd *webhookDispatcher) dispatch(message MessageData) {
+
+	wd.rm.RLock()
+
+	var receivers []Webhook
+
+	for _, webhook := range wd.webhooks[message.Topic] {
+
+		if !wd.r.eb.canAccess(message.Topic, webhook.Subscriber) {
+			continue
+		}
+
+		if webhook.Radius == 0 || checkDistance(webhook.Latitude, message.Latitude, webhook.Longitude,
+			message.Longitude, webhook.Radius, message.Radius) {
+
+			receivers = append(receivers, webhook)
+		}
+	}
+
+	wd.rm.RUnlock()
+
+	for _, webhook := range receivers {
+
+		//deliveries of messages accepted while shutting down are not started, nothing waits for them
+		if !backgroundWorkers.start() {
+
+			slog.Warn("webhook delivery skipped on shutdown", "webhook", webhook.ID, "topic", message.Topic)
+			continue
+		}
+
+		go func(webhook Webhook) {
+
+			defer backgroundWorkers.done()
+			wd.deliver(webhook, message)
+		}(webhook)
+	}
+}
+
+//POSTing message to webhook, retrying with exponential backoff and parking it in dead-letter list on failure
+func (wd *webhookDispatcher) deliver(webhook Webhook, message MessageData) {
+
+	body, err := json.Marshal(message)
+
+	if err != nil {
+		slog.Error("webhook payload not encoded", "webhook", webhook.ID, "error", err)
+		return
+	}
+
+	backoff := time.Millisecond * time.Duration(config().WebhookBackoff)
+	attempts := 0
+
+	for {
+
+		attempts++
+		err = wd.post(message, webhook, body)
+
+		if err == nil {
+			return
+		}
+
+		if attempts > config().WebhookRetryLimit {
+			break
+		}
+
+		//pending retries are parked in dead-letter list on shutdown
+		if !sleepOrShutdown(backoff) {
+			break
+		}
+
+		backoff *= 2
+	}
+
+	slog.Warn("webhook delivery failed", "webhook", webhook.ID, "user", webhook.Subscriber, "topic", message.Topic,
+		"attempts", attempts, "error", err)
+
+	deadLetter, _ := json.Marshal(WebhookDeadLetter{
+		WebhookID: webhook.ID,
+		URL:       webhook.URL,
+		Message:   message,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		FailedAt:  time.Now().Local(),
+	})
+
+	key := "webhook-dead-letters:" + webhook.Subscriber
+
+	err = client.LPush(ctx, key, deadLetter).Err()
+
+	if err == nil {
+		err = client.LTrim(ctx, key, 0, config().WebhookDeadLetterLimit-1).Err()
+	}
+
+	if err != nil {
+		slog.Error("webhook dead letter not stored", "webhook", webhook.ID, "error", err)
+	}
+}
+
+func (wd *webhookDispatcher) post(message MessageData, webhook Webhook, body []byte) (err error) {
+
+	ctx, span := startDeliverySpan(message, "webhook deliver", attribute.Int("sdcc.webhook.id", webhook.ID))
+	defer func() { endSpan(span, err) }()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+
+	request.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("X-Webhook-ID", strconv.Itoa(webhook.ID))
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	request.Header.Set("X-Signature-256", "sha256="+signPayload(webhook.Secret, timestamp, body))
+
+	response, err := wd.client.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	_ = response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("unexpected status " + response.Status)
+	}
+
+	return nil
+}
+
+//Computing hex encoded HMAC-SHA256 of timestamp + "." + payload, so that receivers can refuse old deliveries sent again
+func signPayload(secret string, timestamp string, payload []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Checking if webhooks may reach ip: loopback, private, link-local (e.g. cloud metadata), multicast and unspecified
+//addresses belong to the broker network and are refused
+func publicAddress(ip net.IP) bool {
+
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func webhookHostAllowed(host string) bool {
+
+	return host != "" && stringInSlice(strings.ToLower(host), config().webhookAllowedHosts())
+}
+
+//Checking that host of a webhook URL resolves to public addresses only, unless listed in webhook-allowed-hosts
+func checkWebhookHost(ctx context.Context, host string) error {
+
+	if webhookHostAllowed(host) {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+
+		if !publicAddress(address.IP) {
+			return fmt.Errorf("%s resolves to internal address %s", host, address.IP)
+		}
+	}
+
+	return nil
+}
+
+//Dialing webhook receivers, also after redirects, checking the address actually connected to: a host may resolve to
+//another address than at registration
+func dialWebhook(ctx context.Context, network string, address string) (net.Conn, error) {
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	if host, _, err := net.SplitHostPort(address); err != nil || !webhookHostAllowed(host) {
+
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+
+			host, _, err := net.SplitHostPort(address)
+
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("webhook address %s is internal", host)
+			}
+
+			return nil
+		}
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+//Listing user webhooks
+func (r *Receivers) webhooks(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	r.hooks.rm.RLock()
+
+	results := []Webhook{}
+
+	for _, webhooks := range r.hooks.webhooks {
+
+		for _, webhook := range webhooks {
+
+			if webhook.Subscriber == email {
+
+				webhook.Secret = ""
+				results = append(results, webhook)
+			}
+		}
+	}
+
+	r.hooks.rm.RUnlock()
+
+	c.JSON(http.StatusOK, results)
+}
+
+//Registering a webhook for a topic, the secret is generated if not provided
+func (r *Receivers) registerWebhook(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var webhook Webhook
+	err = json.NewDecoder(c.Request.Body).Decode(&webhook)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	target, err := url.Parse(webhook.URL)
+
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+
+		c.JSON(http.StatusBadRequest, "Invalid webhook URL")
+		return
+	}
+
+	if err = checkWebhookHost(c.Request.Context(), target.Hostname()); err != nil {
+
+		c.JSON(http.StatusBadRequest, "Webhook URL not allowed: "+err.Error())
+		return
+	}
+
+	if !r.eb.hasTopic(webhook.Topic) {
+
+		c.JSON(http.StatusBadRequest, "Unknown topic "+webhook.Topic)
+		return
+	}
+
+	if !r.eb.canAccess(webhook.Topic, email) {
+
+		c.JSON(http.StatusForbidden, "Not a member of private topic "+webhook.Topic)
+		return
+	}
+
+	if webhook.Radius < 0 {
+
+		c.JSON(http.StatusBadRequest, "Invalid radius")
+		return
+	}
+
+	if webhook.Secret == "" {
+
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+
+		if err != nil {
+			failRequest(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.Subscriber = email
+
+	err = r.dbServer.db.QueryRow(`INSERT INTO webhooks (subscriber, topic, url, secret, radius, latitude, longitude)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`, webhook.Subscriber, webhook.Topic, webhook.URL, webhook.Secret,
+		webhook.Radius, webhook.Latitude, webhook.Longitude).Scan(&webhook.ID)
+
+	if err != nil {
+		dbErrors.WithLabelValues("insert-webhook").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	r.hooks.add(webhook)
+	r.cluster.broadcast(ClusterEvent{Type: eventWebhooks})
+	withLogFields(c, "topic", webhook.Topic).Info("webhook registered", "webhook", webhook.ID)
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+//Removing a user webhook
+func (r *Receivers) removeWebhook(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	var webhook Webhook
+	err = json.NewDecoder(c.Request.Body).Decode(&webhook)
+
+	if err != nil {
+		failRequest(c, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := r.dbServer.db.Exec(`DELETE FROM webhooks WHERE id = $1 AND subscriber = $2`, webhook.ID, email)
+
+	if err != nil {
+		dbErrors.WithLabelValues("delete-webhook").Inc()
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+
+		c.JSON(http.StatusNotFound, "Webhook not found")
+		return
+	}
+
+	r.hooks.remove(webhook.ID)
+	r.cluster.broadcast(ClusterEvent{Type: eventWebhooks})
+
+	c.JSON(http.StatusOK, "Webhook removed")
+}
+
+//Listing user deliveries parked in dead-letter list
+func webhookDeadLetters(c *gin.Context) {
+
+	email, err := checkSession(c)
+
+	if err != nil {
+		return
+	}
+
+	items, err := client.LRange(c.Request.Context(), "webhook-dead-letters:"+email, 0, -1).Result()
+
+	if err != nil {
+		failRequest(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	results := []WebhookDeadLetter{}
+
+	for _, item := range items {
+
+		var deadLetter WebhookDeadLetter
+
+		if json.Unmarshal([]byte(item), &deadLetter) == nil {
+			results = append(results, deadLetter)
+		}
+	}
+
+	c.JSON(http.StatusOK, results)
+}
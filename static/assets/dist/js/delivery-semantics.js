@@ -1,3 +1,22 @@
+//Body of a publish: the message as JSON, or a multipart form with the message and the chosen attachments
+function publishData(message) {
+
+    var files = $('#attachments').prop('files');
+
+    if (!files || files.length === 0) {
+        return JSON.stringify(message);
+    }
+
+    var form = new FormData();
+    form.append("message", JSON.stringify(message));
+
+    $.each(files, function (i, file) {
+        form.append("attachments", file);
+    });
+
+    return form;
+}
+
 function getPositionAtLeastOnce(position) {
 
     var title = $('#title').val();
@@ -12,19 +31,29 @@ function getPositionAtLeastOnce(position) {
         type: "POST",
         url: "/publish",
         timeout: $('#deliveryTimeout').val(),
-        data: JSON.stringify({
+        processData: false,
+        contentType: false,
+        data: publishData({
             Message: message, Topic: topic, Title: title, Radius: radius, LifeTime: lifeTime,
             Latitude: latitude, Longitude: longitude
         }),
         success: function (data) {
-            if (data === "fail") {
+            if (data.Result === "fail") {
                 $.ajax(this);
+            } else if (data.Result === "rejected") {
+                alert(data.Reason);
             } else {
                 alert("Message Published!");
                 window.location.href = '/publishPage'
             }
         },
         error: function (jqXHR, textStatus) {
+            if (jqXHR.status === 429) {
+                alert(jqXHR.responseJSON.Reason + ", retry in " + jqXHR.getResponseHeader("Retry-After") + " seconds");
+            }
+            if (jqXHR.status === 400 && jqXHR.responseJSON && jqXHR.responseJSON.Reason) {
+                alert(jqXHR.responseJSON.Reason);
+            }
             if (textStatus === 'timeout') {
                 $.ajax(this);
             }
@@ -52,19 +81,29 @@ function getPositionAtMostOnce(position) {
         timeout: $('#deliveryTimeout').val(),
         tryCount: 0,
         retryLimit: $('#retryLimit').val(),
-        data: JSON.stringify({
+        processData: false,
+        contentType: false,
+        data: publishData({
             Message: message, Topic: topic, Title: title, Radius: radius, LifeTime: lifeTime,
             Latitude: latitude, Longitude: longitude, RequestID: id
         }),
         success: function (data) {
-            if (data === "fail") {
+            if (data.Result === "fail") {
                 $.ajax(this);
+            } else if (data.Result === "rejected") {
+                alert(data.Reason);
             } else {
                 alert("Message Published!");
                 window.location.href = '/publishPage'
             }
         },
         error: function (jqXHR, textStatus) {
+            if (jqXHR.status === 429) {
+                alert(jqXHR.responseJSON.Reason + ", retry in " + jqXHR.getResponseHeader("Retry-After") + " seconds");
+            }
+            if (jqXHR.status === 400 && jqXHR.responseJSON && jqXHR.responseJSON.Reason) {
+                alert(jqXHR.responseJSON.Reason);
+            }
             if (textStatus === 'timeout') {
                 this.tryCount++;
                 if (this.tryCount < this.retryLimit) {
@@ -94,13 +133,17 @@ function getPositionExactlyOnce(position) {
         type: "POST",
         url: "/publish",
         timeout: $('#deliveryTimeout').val(),
-        data: JSON.stringify({
+        processData: false,
+        contentType: false,
+        data: publishData({
             Message: message, Topic: topic, Title: title, Radius: radius, LifeTime: lifeTime,
             Latitude: latitude, Longitude: longitude, RequestID: id
         }),
         success: function (data) {
-            if (data === "fail") {
+            if (data.Result === "fail") {
                 $.ajax(this);
+            } else if (data.Result === "rejected") {
+                alert(data.Reason);
             } else {
                 alert("Message Published!");
                 $.ajax({
@@ -114,6 +157,12 @@ function getPositionExactlyOnce(position) {
             }
         },
         error: function (jqXHR, textStatus) {
+            if (jqXHR.status === 429) {
+                alert(jqXHR.responseJSON.Reason + ", retry in " + jqXHR.getResponseHeader("Retry-After") + " seconds");
+            }
+            if (jqXHR.status === 400 && jqXHR.responseJSON && jqXHR.responseJSON.Reason) {
+                alert(jqXHR.responseJSON.Reason);
+            }
             if (textStatus === 'timeout') {
                 $.ajax(this);
             }